@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"sync"
+)
+
+// ByteBudget limits the number of bytes in flight at once. Requests for more
+// than the whole budget wait until nothing else is in flight, rather than
+// forever.
+type ByteBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	total int64
+	used  int64
+}
+
+func NewByteBudget(total int64) *ByteBudget {
+	b := &ByteBudget{total: total}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// clamp limits n to the whole budget.
+func (b *ByteBudget) clamp(n int64) int64 {
+	if n > b.total {
+		return b.total
+	} else if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Acquire blocks until n bytes are available, and takes them.
+func (b *ByteBudget) Acquire(n int64) {
+	n = b.clamp(n)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used+n > b.total {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+// Release returns n bytes taken by Acquire.
+func (b *ByteBudget) Release(n int64) {
+	n = b.clamp(n)
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
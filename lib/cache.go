@@ -5,11 +5,54 @@ import (
 )
 
 type Cache interface {
-	Set(ns, k string, v []byte)
-	Get(ns, k string) ([]byte, bool)
-	Del(ns, k string)
-	Items(ns string, ks chan<- string)
-	Close()
+	Set(ns, k string, v []byte) error
+	Get(ns, k string) ([]byte, bool, error)
+	Del(ns, k string) error
+	// Items sends every key in ns to ks, then closes ks. The returned channel
+	// yields the error that stopped iteration, if any, once ks is closed.
+	Items(ns string, ks chan<- string) <-chan error
+	// Namespaces returns every namespace holding at least one key.
+	Namespaces() ([]string, error)
+	// Batch calls f with a Cache whose writes are committed atomically if f
+	// returns nil, and discarded otherwise. The Cache passed to f must not be
+	// used after f returns, nor from other goroutines.
+	Batch(f func(Cache) error) error
+	// Backup writes a consistent copy of the cache to the file at path.
+	Backup(path string) error
+	Close() error
+}
+
+// CopyCache copies every key in src to dst, in a single batch.
+func CopyCache(dst, src Cache) error {
+	nss, err := src.Namespaces()
+	if err != nil {
+		return err
+	}
+	return dst.Batch(func(tc Cache) error {
+		for _, ns := range nss {
+			ks := make(chan string)
+			errs := src.Items(ns, ks)
+			var keys []string
+			for k := range ks {
+				keys = append(keys, k)
+			}
+			if err := <-errs; err != nil {
+				return err
+			}
+			for _, k := range keys {
+				v, ok, err := src.Get(ns, k)
+				if err != nil {
+					return err
+				} else if !ok {
+					continue
+				}
+				if err := tc.Set(ns, k, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
 }
 
 type BoltCache struct {
@@ -22,66 +65,165 @@ func NewBoltCache(path string) (BoltCache, error) {
 	return BoltCache{db: db}, err
 }
 
-func (c BoltCache) Set(ns, k string, v []byte) {
-	if err := c.db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte(ns))
-		if err != nil {
-			return err
-		}
-		return b.Put([]byte(k), v)
-	}); err != nil {
-		panic(err)
-	}
+func (c BoltCache) Set(ns, k string, v []byte) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return boltTx{tx}.Set(ns, k, v)
+	})
 }
 
-func (c BoltCache) Get(ns, k string) ([]byte, bool) {
+func (c BoltCache) Get(ns, k string) ([]byte, bool, error) {
 	var b []byte
 	var ok bool
-	if err := c.db.View(func(tx *bolt.Tx) error {
-		bk := tx.Bucket([]byte(ns))
-		if bk == nil {
-			b, ok = nil, false
-			return nil
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		b, ok, err = boltTx{tx}.Get(ns, k)
+		return err
+	})
+	return b, ok, err
+}
+
+func (c BoltCache) Del(ns, k string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return boltTx{tx}.Del(ns, k)
+	})
+}
+
+func (c BoltCache) Items(ns string, ks chan<- string) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(ks)
+		// Collect the keys before sending them, so that consumers are free to
+		// write to the cache while iterating without deadlocking against our
+		// read transaction.
+		var keys []string
+		if err := c.db.View(func(tx *bolt.Tx) error {
+			var err error
+			keys, err = boltTx{tx}.keys(ns)
+			return err
+		}); err != nil {
+			errs <- err
+			return
 		}
-		v := bk.Get([]byte(k))
-		if v == nil {
-			b, ok = nil, false
-			return nil
+		for _, k := range keys {
+			ks <- k
 		}
-		b, ok = v, true
-		return nil
-	}); err != nil {
-		panic(err)
+	}()
+	return errs
+}
+
+func (c BoltCache) Namespaces() ([]string, error) {
+	var nss []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		nss, err = boltTx{tx}.Namespaces()
+		return err
+	})
+	return nss, err
+}
+
+func (c BoltCache) Batch(f func(Cache) error) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return f(boltTx{tx})
+	})
+}
+
+func (c BoltCache) Backup(path string) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		return boltTx{tx}.Backup(path)
+	})
+}
+
+func (c BoltCache) Close() error {
+	return c.db.Close()
+}
+
+// boltTx is a Cache backed by a single bolt transaction.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Set(ns, k string, v []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(ns))
+	if err != nil {
+		return err
 	}
-	return b, ok
+	return b.Put([]byte(k), v)
 }
 
-func (c BoltCache) Del(ns, k string) {
-	if err := c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(ns))
-		if b != nil {
-			b.Delete([]byte(k))
-		}
+func (t boltTx) Get(ns, k string) ([]byte, bool, error) {
+	b := t.tx.Bucket([]byte(ns))
+	if b == nil {
+		return nil, false, nil
+	}
+	v := b.Get([]byte(k))
+	if v == nil {
+		return nil, false, nil
+	}
+	// v is only valid for the life of the transaction.
+	return append([]byte{}, v...), true, nil
+}
+
+func (t boltTx) Del(ns, k string) error {
+	b := t.tx.Bucket([]byte(ns))
+	if b == nil {
 		return nil
-	}); err != nil {
-		panic(err)
 	}
+	return b.Delete([]byte(k))
 }
 
-func (c BoltCache) Items(ns string, ks chan<- string) {
+func (t boltTx) keys(ns string) ([]string, error) {
+	var keys []string
+	b := t.tx.Bucket([]byte(ns))
+	if b == nil {
+		return keys, nil
+	}
+	err := b.ForEach(func(k, _ []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	return keys, err
+}
+
+func (t boltTx) Items(ns string, ks chan<- string) <-chan error {
+	errs := make(chan error, 1)
+	// The transaction can't be shared with another goroutine, so read the keys
+	// now and only send them asynchronously.
+	keys, err := t.keys(ns)
 	go func() {
+		defer close(errs)
 		defer close(ks)
-		if err := c.db.View(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(ns))
-			if b == nil {
-				return nil
-			}
-			return b.ForEach(func(k, _ []byte) error {
-				ks <- string(k)
-				return nil
-			})
-		}); err != nil {
-			panic(err)
+		if err != nil {
+			errs <- err
+			return
+		}
+		for _, k := range keys {
+			ks <- k
 		}
 	}()
+	return errs
+}
+
+func (t boltTx) Namespaces() ([]string, error) {
+	var nss []string
+	err := t.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if k, _ := b.Cursor().First(); k != nil {
+			nss = append(nss, string(name))
+		}
+		return nil
+	})
+	return nss, err
+}
+
+// Batch runs f within the enclosing transaction.
+func (t boltTx) Batch(f func(Cache) error) error {
+	return f(t)
+}
+
+func (t boltTx) Backup(path string) error {
+	return t.tx.CopyFile(path, 0600)
+}
+
+func (t boltTx) Close() error {
+	return nil
 }
@@ -0,0 +1,119 @@
+package gmail
+
+import (
+	"log"
+
+	"github.com/meelapshah/outtake/lib"
+	"github.com/meelapshah/outtake/lib/oauth"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// Features selects optional behaviors that need more than read-only access to
+// the mailbox. The zero value is a read-only backup.
+type Features uint
+
+const (
+	// WriteBack pushes local notmuch tag changes back to Gmail labels.
+	WriteBack Features = 1 << iota
+	// Send allows sending mail on the user's behalf.
+	Send
+	// PermanentDelete allows deleting messages without going through the trash.
+	PermanentDelete
+	// Drafts uploads drafts written to the drafts folder to Gmail.
+	Drafts
+)
+
+// scopeImplies lists, for each scope, the narrower scopes it also grants.
+var scopeImplies = map[string][]string{
+	gmail.MailGoogleComScope: {gmail.GmailModifyScope, gmail.GmailComposeScope, gmail.GmailSendScope, gmail.GmailReadonlyScope},
+	gmail.GmailModifyScope:   {gmail.GmailComposeScope, gmail.GmailSendScope, gmail.GmailReadonlyScope},
+	gmail.GmailComposeScope:  {gmail.GmailSendScope},
+}
+
+// Scopes returns the narrowest set of OAuth scopes needed for f.
+func (f Features) Scopes() []string {
+	switch {
+	case f&PermanentDelete != 0:
+		return []string{gmail.MailGoogleComScope}
+	case f&WriteBack != 0:
+		return []string{gmail.GmailModifyScope}
+	}
+	s := []string{gmail.GmailReadonlyScope}
+	if f&Drafts != 0 {
+		s = append(s, gmail.GmailComposeScope)
+	} else if f&Send != 0 {
+		s = append(s, gmail.GmailSendScope)
+	}
+	return s
+}
+
+// scopesCover reports whether the granted scopes allow everything in required.
+func scopesCover(granted, required []string) bool {
+	have := make(map[string]struct{})
+	for _, s := range granted {
+		have[s] = struct{}{}
+		for _, i := range scopeImplies[s] {
+			have[i] = struct{}{}
+		}
+	}
+	for _, s := range required {
+		if _, ok := have[s]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// authorize returns an OAuth token covering the scopes needed for g.features,
+// reusing the cached token when it already covers them. If a feature needing
+// more scope has been enabled since the token was granted, the user is asked
+// to authorize again, incrementally adding the new scopes to the old ones.
+func (g *Gmail) authorize() (*oauth2.Config, *oauth2.Token, error) {
+	required := g.features.Scopes()
+	cfg := &oauth2.Config{
+		ClientID:     oauth.ClientId,
+		ClientSecret: oauth.Secret,
+		Scopes:       required,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+			TokenURL: "https://accounts.google.com/o/oauth2/token",
+		},
+	}
+	tok, ok, err := g.cache.GetOauthToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	granted, err := g.cache.GetOauthScopes()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok && scopesCover(granted, required) {
+		cfg.Scopes = granted
+		return cfg, tok, nil
+	}
+	var opts []oauth2.AuthCodeOption
+	if ok {
+		log.Println("Enabled features need additional access, requesting", required)
+		cfg.Scopes = granted
+		for _, s := range required {
+			if !lib.Contains(cfg.Scopes, s) {
+				cfg.Scopes = append(cfg.Scopes, s)
+			}
+		}
+		opts = append(opts, oauth2.SetAuthURLParam("include_granted_scopes", "true"))
+	}
+	// XXX: should we use a client-specified context here?
+	tok, err = oauth.GetOAuthClient(context.TODO(), cfg, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := g.cache.SetOauthToken(tok); err != nil {
+		return nil, nil, err
+	}
+	if err := g.cache.SetOauthScopes(cfg.Scopes); err != nil {
+		return nil, nil, err
+	}
+	return cfg, tok, nil
+}
@@ -4,18 +4,36 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
 
 	"github.com/meelapshah/outtake/lib"
 	"github.com/meelapshah/outtake/lib/maildir"
 	"golang.org/x/oauth2"
+	gmail "google.golang.org/api/gmail/v1"
 )
 
 const (
 	// Cache key prefixes.
 	midToKey         = "mid_to_key"
 	midToLabels      = "mid_to_label"
+	midToSize        = "mid_to_size"
+	midToSha256      = "mid_to_sha256"
+	midToDate        = "mid_to_date"
+	midToThread      = "mid_to_thread"
+	threadToMids     = "thread_to_mids"
+	draftToMid       = "draft_to_mid"
+	draftToKey       = "draft_to_key"
+	draftToSha256    = "draft_to_sha256"
+	excludedMids     = "excluded"
+	retentionPolicy  = "retention"
 	historyIndex     = "history_index"
 	oauthToken       = "oauth_token"
+	oauthScopes      = "oauth_scopes"
 	gidToMid         = "gid_to_mid"
 	midToGid         = "mid_to_gid"
 	labelToGidPrefix = "label_to_gid_"
@@ -25,114 +43,555 @@ type gmailCache struct {
 	Cache lib.Cache
 }
 
-func (c *gmailCache) GetMessageIdForGmailId(gId string) (string, bool) {
-	if bs, ok := c.Cache.Get(gidToMid, gId); ok {
-		return string(bs), true
+// collectItems drains keys sent by an Items-style iteration into a slice.
+func collectItems(ks <-chan string, errs <-chan error) ([]string, error) {
+	var is []string
+	for k := range ks {
+		is = append(is, k)
 	}
-	return "", false
+	return is, <-errs
 }
 
-func (c *gmailCache) GetGmailIdForMessageId(mId string) (string, bool) {
-	if bs, ok := c.Cache.Get(midToGid, mId); ok {
-		return string(bs), true
+// Batch calls f with a gmailCache whose writes are committed atomically if f
+// returns nil.
+func (c *gmailCache) Batch(f func(c *gmailCache) error) error {
+	return c.Cache.Batch(func(tc lib.Cache) error {
+		return f(&gmailCache{tc})
+	})
+}
+
+func (c *gmailCache) GetMessageIdForGmailId(gId string) (string, bool, error) {
+	bs, ok, err := c.Cache.Get(gidToMid, gId)
+	return string(bs), ok, err
+}
+
+func encodeStrings(ss []string) ([]byte, error) {
+	bs := new(bytes.Buffer)
+	err := gob.NewEncoder(bs).Encode(ss)
+	return bs.Bytes(), err
+}
+
+func decodeStrings(bs []byte) ([]string, error) {
+	ss := []string{}
+	err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&ss)
+	return ss, err
+}
+
+// GetGmailIdsForMessageId returns every Gmail message with Message-Id mId.
+// There can be several, e.g. for mail sent to yourself.
+func (c *gmailCache) GetGmailIdsForMessageId(mId string) ([]string, bool, error) {
+	bs, ok, err := c.Cache.Get(midToGid, mId)
+	if !ok || err != nil {
+		return nil, false, err
 	}
-	return "", false
+	gIds, err := decodeStrings(bs)
+	return gIds, err == nil, err
 }
 
-func (c *gmailCache) SetIds(gId, mId string) {
-	c.Cache.Set(gidToMid, gId, []byte(mId))
-	c.Cache.Set(midToGid, mId, []byte(gId))
+func (c *gmailCache) setGmailIdsForMessageId(mId string, gIds []string) error {
+	if len(gIds) == 0 {
+		return c.Cache.Del(midToGid, mId)
+	}
+	bs, err := encodeStrings(gIds)
+	if err != nil {
+		return err
+	}
+	return c.Cache.Set(midToGid, mId, bs)
 }
 
-func (c *gmailCache) SetGmailLabel(label, gId string) {
-	c.Cache.Set(labelToGidPrefix+label, gId, []byte{})
+// SetIds records that Gmail message gId has Message-Id mId, replacing any
+// Message-Id previously recorded for it.
+func (c *gmailCache) SetIds(gId, mId string) error {
+	if err := c.DelIds(gId); err != nil {
+		return err
+	}
+	if err := c.Cache.Set(gidToMid, gId, []byte(mId)); err != nil {
+		return err
+	}
+	gIds, _, err := c.GetGmailIdsForMessageId(mId)
+	if err != nil {
+		return err
+	}
+	if !lib.Contains(gIds, gId) {
+		gIds = append(gIds, gId)
+	}
+	return c.setGmailIdsForMessageId(mId, gIds)
 }
 
-func (c *gmailCache) HasGmailLabel(label, gId string) bool {
-	_, ok := c.Cache.Get(labelToGidPrefix+label, gId)
-	return ok
+// DelIds forgets the Message-Id of Gmail message gId.
+func (c *gmailCache) DelIds(gId string) error {
+	mId, ok, err := c.GetMessageIdForGmailId(gId)
+	if !ok || err != nil {
+		return err
+	}
+	gIds, _, err := c.GetGmailIdsForMessageId(mId)
+	if err != nil {
+		return err
+	}
+	rest := []string{}
+	for _, id := range gIds {
+		if id != gId {
+			rest = append(rest, id)
+		}
+	}
+	if err := c.setGmailIdsForMessageId(mId, rest); err != nil {
+		return err
+	}
+	return c.Cache.Del(gidToMid, gId)
 }
 
-func (c *gmailCache) DelGmailLabel(label, gId string) {
-	c.Cache.Del(labelToGidPrefix+label, gId)
+func (c *gmailCache) SetGmailLabel(label, gId string) error {
+	return c.Cache.Set(labelToGidPrefix+label, gId, []byte{})
 }
 
-func (c *gmailCache) GmailIdsForLabel(label string, gIdChan chan string) {
-	c.Cache.Items(labelToGidPrefix+label, gIdChan)
+func (c *gmailCache) HasGmailLabel(label, gId string) (bool, error) {
+	_, ok, err := c.Cache.Get(labelToGidPrefix+label, gId)
+	return ok, err
 }
 
-func (c *gmailCache) GetOauthToken() (*oauth2.Token, bool) {
+func (c *gmailCache) DelGmailLabel(label, gId string) error {
+	return c.Cache.Del(labelToGidPrefix+label, gId)
+}
+
+func (c *gmailCache) GmailIdsForLabel(label string, gIdChan chan string) <-chan error {
+	return c.Cache.Items(labelToGidPrefix+label, gIdChan)
+}
+
+func (c *gmailCache) GetOauthToken() (*oauth2.Token, bool, error) {
 	var tok oauth2.Token
-	if bs, ok := c.Cache.Get(oauthToken, "0"); ok {
-		if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&tok); err != nil {
-			panic(err)
-		}
-		return &tok, true
+	bs, ok, err := c.Cache.Get(oauthToken, "0")
+	if !ok || err != nil {
+		return nil, false, err
 	}
-	return nil, false
+	if err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&tok); err != nil {
+		return nil, false, err
+	}
+	return &tok, true, nil
 }
 
-func (c *gmailCache) SetOauthToken(tok *oauth2.Token) {
+func (c *gmailCache) SetOauthToken(tok *oauth2.Token) error {
 	bs := new(bytes.Buffer)
 	if err := gob.NewEncoder(bs).Encode(tok); err != nil {
-		panic(err)
+		return err
 	}
-	c.Cache.Set(oauthToken, "0", bs.Bytes())
+	return c.Cache.Set(oauthToken, "0", bs.Bytes())
 }
 
-func (c *gmailCache) GetMsgKey(m string) (maildir.Key, bool) {
-	k, ok := c.Cache.Get(midToKey, m)
-	return maildir.Key(k), ok
+// GetOauthScopes returns the scopes the cached OAuth token was granted.
+func (c *gmailCache) GetOauthScopes() ([]string, error) {
+	bs, ok, err := c.Cache.Get(oauthScopes, "0")
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		// Tokens cached before scopes were recorded always had full access.
+		return []string{gmail.MailGoogleComScope}, nil
+	}
+	return decodeStrings(bs)
 }
 
-func (c *gmailCache) SetMsgKey(m string, k maildir.Key) {
-	c.Cache.Set(midToKey, m, []byte(k))
+func (c *gmailCache) SetOauthScopes(ss []string) error {
+	bs, err := encodeStrings(ss)
+	if err != nil {
+		return err
+	}
+	return c.Cache.Set(oauthScopes, "0", bs)
 }
 
-func (g *gmailCache) GetMsgs(ms chan<- string) {
-	g.Cache.Items(midToKey, ms)
+func (c *gmailCache) GetMsgKey(m string) (maildir.Key, bool, error) {
+	k, ok, err := c.Cache.Get(midToKey, m)
+	return maildir.Key(k), ok, err
 }
 
-func (c *gmailCache) DelMsg(m string) {
-	c.Cache.Del(midToKey, m)
-	c.Cache.Del(midToLabels, m)
-	mId, ok := c.GetMessageIdForGmailId(m)
-	if ok {
-		c.Cache.Del(midToGid, mId)
+func (c *gmailCache) SetMsgKey(m string, k maildir.Key) error {
+	return c.Cache.Set(midToKey, m, []byte(k))
+}
+
+func (g *gmailCache) GetMsgs(ms chan<- string) <-chan error {
+	return g.Cache.Items(midToKey, ms)
+}
+
+func (c *gmailCache) DelMsg(m string) error {
+	if err := c.Cache.Del(midToKey, m); err != nil {
+		return err
+	}
+	if err := c.Cache.Del(midToLabels, m); err != nil {
+		return err
+	}
+	if err := c.Cache.Del(midToSize, m); err != nil {
+		return err
 	}
-	c.Cache.Del(gidToMid, m)
+	if err := c.Cache.Del(midToSha256, m); err != nil {
+		return err
+	}
+	if err := c.Cache.Del(midToDate, m); err != nil {
+		return err
+	}
+	if err := c.DelThreadId(m); err != nil {
+		return err
+	}
+	return c.DelIds(m)
+}
+
+func (c *gmailCache) GetMsgLabels(m string) ([]string, bool, error) {
+	bls, ok, err := c.Cache.Get(midToLabels, m)
+	if !ok || err != nil {
+		return []string{}, false, err
+	}
+	ls, err := decodeStrings(bls)
+	if err != nil {
+		return ls, false, err
+	}
+	return ls, ok, nil
+}
+
+func (c *gmailCache) SetMsgLabels(m string, ls []string) error {
+	bls, err := encodeStrings(ls)
+	if err != nil {
+		return err
+	}
+	return c.Cache.Set(midToLabels, m, bls)
+}
+
+// msgDigest is what we know of a message's contents, to detect corruption.
+type msgDigest struct {
+	// Size is Gmail's estimate of the message size, or 0 if unknown.
+	Size int64
+	// Sha256 is the hex SHA-256 of the maildir file.
+	Sha256 string
+}
+
+// GetMsgDigest returns the digest recorded for message m. ok is false if no
+// hash was recorded, e.g. for messages downloaded by older versions.
+func (c *gmailCache) GetMsgDigest(m string) (msgDigest, bool, error) {
+	d := msgDigest{}
+	sum, ok, err := c.Cache.Get(midToSha256, m)
+	if !ok || err != nil {
+		return d, false, err
+	}
+	d.Sha256 = string(sum)
+	if b, ok, err := c.Cache.Get(midToSize, m); err != nil {
+		return d, false, err
+	} else if ok {
+		n, _ := binary.Uvarint(b)
+		d.Size = int64(n)
+	}
+	return d, true, nil
+}
+
+func (c *gmailCache) SetMsgSize(m string, n int64) error {
+	b := make([]byte, binary.MaxVarintLen64)
+	binary.PutUvarint(b, uint64(n))
+	return c.Cache.Set(midToSize, m, b)
+}
+
+func (c *gmailCache) SetMsgSha256(m, sum string) error {
+	return c.Cache.Set(midToSha256, m, []byte(sum))
 }
 
-func (c *gmailCache) GetMsgLabels(m string) ([]string, bool) {
-	ls := []string{}
-	bls, ok := c.Cache.Get(midToLabels, m)
-	if !ok {
-		return ls, false
+// GetMsgDate returns the time Gmail received message m. ok is false for
+// messages cached before dates were recorded.
+func (c *gmailCache) GetMsgDate(m string) (time.Time, bool, error) {
+	b, ok, err := c.Cache.Get(midToDate, m)
+	if !ok || err != nil {
+		return time.Time{}, false, err
 	}
-	if err := gob.NewDecoder(bytes.NewBuffer(bls)).Decode(&ls); err != nil {
-		panic(err)
+	ms, _ := binary.Uvarint(b)
+	return internalTime(int64(ms)), true, nil
+}
+
+// SetMsgDate records Gmail's internal date of message m, in milliseconds
+// since the epoch.
+func (c *gmailCache) SetMsgDate(m string, ms int64) error {
+	b := make([]byte, binary.MaxVarintLen64)
+	binary.PutUvarint(b, uint64(ms))
+	return c.Cache.Set(midToDate, m, b)
+}
+
+// GetThreadId returns the Gmail thread of message m.
+func (c *gmailCache) GetThreadId(m string) (string, bool, error) {
+	bs, ok, err := c.Cache.Get(midToThread, m)
+	return string(bs), ok, err
+}
+
+// GetThreadMsgs returns the Gmail messages in thread t.
+func (c *gmailCache) GetThreadMsgs(t string) ([]string, bool, error) {
+	bs, ok, err := c.Cache.Get(threadToMids, t)
+	if !ok || err != nil {
+		return nil, false, err
 	}
-	return ls, ok
+	ms, err := decodeStrings(bs)
+	return ms, err == nil, err
 }
 
-func (c *gmailCache) SetMsgLabels(m string, ls []string) {
-	bls := new(bytes.Buffer)
-	if err := gob.NewEncoder(bls).Encode(ls); err != nil {
-		panic(err)
+func (c *gmailCache) setThreadMsgs(t string, ms []string) error {
+	if len(ms) == 0 {
+		return c.Cache.Del(threadToMids, t)
+	}
+	bs, err := encodeStrings(ms)
+	if err != nil {
+		return err
+	}
+	return c.Cache.Set(threadToMids, t, bs)
+}
+
+// GetThreads sends the ID of every thread with a cached message to ts.
+func (c *gmailCache) GetThreads(ts chan<- string) <-chan error {
+	return c.Cache.Items(threadToMids, ts)
+}
+
+// SetThreadId records that message m is in thread t.
+func (c *gmailCache) SetThreadId(m, t string) error {
+	if err := c.DelThreadId(m); err != nil {
+		return err
+	}
+	if err := c.Cache.Set(midToThread, m, []byte(t)); err != nil {
+		return err
+	}
+	ms, _, err := c.GetThreadMsgs(t)
+	if err != nil {
+		return err
 	}
-	c.Cache.Set(midToLabels, m, bls.Bytes())
+	return c.setThreadMsgs(t, append(ms, m))
 }
 
-func (c *gmailCache) GetHistoryIdx() uint64 {
+// DelThreadId forgets the thread of message m.
+func (c *gmailCache) DelThreadId(m string) error {
+	t, ok, err := c.GetThreadId(m)
+	if !ok || err != nil {
+		return err
+	}
+	ms, _, err := c.GetThreadMsgs(t)
+	if err != nil {
+		return err
+	}
+	rest := []string{}
+	for _, id := range ms {
+		if id != m {
+			rest = append(rest, id)
+		}
+	}
+	if err := c.setThreadMsgs(t, rest); err != nil {
+		return err
+	}
+	return c.Cache.Del(midToThread, m)
+}
+
+// draftState is what we know of a draft synced to the drafts folder.
+type draftState struct {
+	// MsgId is the Gmail ID of the draft's message, which changes with every
+	// edit.
+	MsgId string
+	// Key is the draft's file in the drafts folder.
+	Key maildir.Key
+	// Sha256 is the hex SHA-256 of that file, to notice local edits.
+	Sha256 string
+}
+
+// GetDraft returns what is known of draft d.
+func (c *gmailCache) GetDraft(d string) (draftState, bool, error) {
+	s := draftState{}
+	for _, f := range []struct {
+		ns string
+		v  *string
+	}{{draftToMid, &s.MsgId}, {draftToKey, (*string)(&s.Key)}, {draftToSha256, &s.Sha256}} {
+		bs, ok, err := c.Cache.Get(f.ns, d)
+		if !ok || err != nil {
+			return s, false, err
+		}
+		*f.v = string(bs)
+	}
+	return s, true, nil
+}
+
+// SetDraft records the state of draft d.
+func (c *gmailCache) SetDraft(d string, s draftState) error {
+	if err := c.Cache.Set(draftToMid, d, []byte(s.MsgId)); err != nil {
+		return err
+	}
+	if err := c.Cache.Set(draftToKey, d, []byte(s.Key)); err != nil {
+		return err
+	}
+	return c.Cache.Set(draftToSha256, d, []byte(s.Sha256))
+}
+
+// DelDraft forgets draft d.
+func (c *gmailCache) DelDraft(d string) error {
+	for _, ns := range []string{draftToMid, draftToKey, draftToSha256} {
+		if err := c.Cache.Del(ns, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDrafts sends the ID of every synced draft to ds.
+func (c *gmailCache) GetDrafts(ds chan<- string) <-chan error {
+	return c.Cache.Items(draftToMid, ds)
+}
+
+// IsExcluded reports whether message m was left out by the retention policy.
+func (c *gmailCache) IsExcluded(m string) (bool, error) {
+	_, ok, err := c.Cache.Get(excludedMids, m)
+	return ok, err
+}
+
+// SetExcluded records that message m was left out by the retention policy,
+// so that it isn't fetched again.
+func (c *gmailCache) SetExcluded(m string) error {
+	return c.Cache.Set(excludedMids, m, []byte{})
+}
+
+func (c *gmailCache) DelExcluded(m string) error {
+	return c.Cache.Del(excludedMids, m)
+}
+
+// GetExcluded sends the ID of every excluded message to ms.
+func (c *gmailCache) GetExcluded(ms chan<- string) <-chan error {
+	return c.Cache.Items(excludedMids, ms)
+}
+
+// GetRetention returns the retention policy of the last sync.
+func (c *gmailCache) GetRetention() (retention, error) {
+	r := retention{}
+	bs, ok, err := c.Cache.Get(retentionPolicy, "0")
+	if !ok || err != nil {
+		return r, err
+	}
+	return r, json.Unmarshal(bs, &r)
+}
+
+func (c *gmailCache) SetRetention(r retention) error {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return c.Cache.Set(retentionPolicy, "0", bs)
+}
+
+func (c *gmailCache) GetHistoryIdx() (uint64, error) {
 	hidx := uint64(0)
-	if b, ok := c.Cache.Get(historyIndex, "0"); ok {
+	b, ok, err := c.Cache.Get(historyIndex, "0")
+	if ok {
 		hidx, _ = binary.Uvarint(b)
 	}
-	return hidx
+	return hidx, err
 }
 
-func (c *gmailCache) SetHistoryIdx(i uint64) {
-	b := make([]byte, 8)
+func (c *gmailCache) SetHistoryIdx(i uint64) error {
+	b := make([]byte, binary.MaxVarintLen64)
 	binary.PutUvarint(b, i)
-	c.Cache.Set(historyIndex, "0", b)
+	return c.Cache.Set(historyIndex, "0", b)
+}
+
+// Cache backends.
+const (
+	BoltBackend   = "bolt"
+	SQLiteBackend = "sqlite"
+)
+
+// cachePath returns the path of backend's cache file in dir.
+func cachePath(dir, backend string) (string, error) {
+	switch backend {
+	case BoltBackend:
+		return path.Join(dir, cacheFile), nil
+	case SQLiteBackend:
+		return path.Join(dir, cacheFile+".sqlite"), nil
+	}
+	return "", fmt.Errorf("unknown cache backend %q", backend)
+}
+
+func openCache(f, backend string) (lib.Cache, error) {
+	if backend == SQLiteBackend {
+		return newSQLiteCache(f)
+	}
+	return lib.NewBoltCache(f)
+}
+
+// openGmailCache opens the CacheBackend cache in dir, upgrading it to the
+// current schema.
+func openGmailCache(dir string) (*gmailCache, error) {
+	f, err := cachePath(dir, CacheBackend)
+	if err != nil {
+		return nil, err
+	}
+	if CacheBackend != BoltBackend {
+		// Don't silently start over next to an existing bolt cache.
+		if ok, err := exists(f); err != nil {
+			return nil, err
+		} else if old, _ := cachePath(dir, BoltBackend); !ok {
+			if ok, err := exists(old); err != nil {
+				return nil, err
+			} else if ok {
+				return nil, fmt.Errorf("found a bolt cache at %s; run migrate-cache to convert it to %s", old, CacheBackend)
+			}
+		}
+	}
+	c, err := openCache(f, CacheBackend)
+	if err != nil {
+		return nil, err
+	}
+	gc := &gmailCache{c}
+	if err := migrateCache(gc, f); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return gc, nil
+}
+
+func exists(f string) (bool, error) {
+	if _, err := os.Stat(f); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MigrateCache copies the cache in dir from the from backend to the to
+// backend, upgrading its schema first. The old cache is left in place.
+func MigrateCache(dir, from, to string) error {
+	src, err := cachePath(dir, from)
+	if err != nil {
+		return err
+	}
+	dst, err := cachePath(dir, to)
+	if err != nil {
+		return err
+	}
+	if ok, err := exists(src); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("no %s cache at %s", from, src)
+	}
+	if ok, err := exists(dst); err != nil {
+		return err
+	} else if ok {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	sc, err := openCache(src, from)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	if err := migrateCache(&gmailCache{sc}, src); err != nil {
+		return err
+	}
+	// Copy into a temporary file, so that a failed copy doesn't leave a
+	// partial cache behind.
+	tmp := dst + ".tmp"
+	os.Remove(tmp)
+	dc, err := openCache(tmp, to)
+	if err != nil {
+		return err
+	}
+	if err := lib.CopyCache(dc, sc); err != nil {
+		dc.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dc.Close(); err != nil {
+		return err
+	}
+	log.Printf("Copied %s cache to %s", from, dst)
+	return os.Rename(tmp, dst)
 }
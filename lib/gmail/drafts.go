@@ -0,0 +1,279 @@
+package gmail
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/mail"
+
+	"github.com/meelapshah/outtake/lib"
+	"github.com/meelapshah/outtake/lib/maildir"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	draftLabel = "DRAFT"
+	// The Maildir++ folder drafts are synced to, inside the maildir.
+	draftsFolder = ".Drafts"
+	// Header recording the Gmail ID of a draft, so that a copy edited by a
+	// mail reader updates the draft rather than creating another.
+	draftIdHeader = "X-GM-Draft-Id"
+	// Maildir flags of synced drafts: draft, and seen.
+	draftFlags = "DS"
+)
+
+// localDraft is a file in the drafts folder to upload to Gmail.
+type localDraft struct {
+	// Id is the draft it updates, or empty for a new draft.
+	Id  string
+	Key maildir.Key
+	Raw []byte
+}
+
+// SyncDrafts mirrors Gmail's drafts in draftsFolder, each with the D flag.
+// If the Drafts feature is enabled, drafts written or edited there by a mail
+// reader are first uploaded to Gmail. Editing a draft replaces its message
+// with one with a new ID, so drafts are tracked by their draft ID, and their
+// file is replaced when their message changes.
+func (g *Gmail) SyncDrafts() error {
+	d, err := g.dir.Folder(draftsFolder)
+	if err != nil {
+		return err
+	}
+	if err := g.dropDraftCopies(); err != nil {
+		return err
+	}
+	if g.features&Drafts != 0 {
+		if err := g.pushDrafts(d); err != nil {
+			return err
+		}
+	} else {
+		log.Println("Draft upload disabled, not uploading local drafts")
+	}
+	return g.pullDrafts(d)
+}
+
+// dropDraftCopies removes the drafts that were synced to the maildir as
+// ordinary messages, before drafts were synced to draftsFolder.
+func (g *Gmail) dropDraftCopies() error {
+	is := make(chan string)
+	ids, err := collectItems(is, g.cache.GetMsgs(is))
+	if err != nil {
+		return err
+	}
+	var drafts []string
+	for _, id := range ids {
+		labels, _, err := g.cache.GetMsgLabels(id)
+		if err != nil {
+			return err
+		} else if lib.Contains(labels, draftLabel) {
+			drafts = append(drafts, id)
+		}
+	}
+	if len(drafts) == 0 {
+		return nil
+	}
+	if err := g.writeBatch(func(b *batch) error {
+		for _, id := range drafts {
+			if err := g.writeDel(b, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	log.Println("Moved", len(drafts), "drafts to", draftsFolder)
+	return nil
+}
+
+// changedDrafts returns the files in d that are new, or whose contents
+// changed, since they were last synced.
+func (g *Gmail) changedDrafts(d maildir.Maildir) ([]localDraft, error) {
+	byKey := make(map[maildir.Key]string)
+	ds := make(chan string)
+	ids, err := collectItems(ds, g.cache.GetDrafts(ds))
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]draftState)
+	for _, id := range ids {
+		s, ok, err := g.cache.GetDraft(id)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			byKey[s.Key] = id
+			states[id] = s
+		}
+	}
+	var changed []localDraft
+	err = d.Walk(func(m maildir.Message) error {
+		f, err := d.OpenFile(m.Path)
+		if err == maildir.ErrNoIdentity {
+			log.Println("Not uploading encrypted draft", m.Path, "without an identity")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+		raw, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		id, known := byKey[m.Key]
+		if known {
+			if sum := sha256.Sum256(raw); hex.EncodeToString(sum[:]) == states[id].Sha256 {
+				return nil
+			}
+		} else if msg, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+			// A mail reader may save an edited draft as a new file, keeping
+			// our header.
+			if _, ok := states[msg.Header.Get(draftIdHeader)]; ok {
+				id = msg.Header.Get(draftIdHeader)
+			}
+		}
+		changed = append(changed, localDraft{Id: id, Key: m.Key, Raw: raw})
+		return nil
+	})
+	return changed, err
+}
+
+// pushDrafts uploads the drafts written or edited locally.
+func (g *Gmail) pushDrafts(d maildir.Maildir) error {
+	changed, err := g.changedDrafts(d)
+	if err != nil {
+		return err
+	}
+	for _, l := range changed {
+		raw := spliceHeader(l.Raw, draftIdHeader, nil)
+		var dr *gmail.Draft
+		if l.Id == "" {
+			dr, err = g.svc.CreateDraft(raw)
+		} else if dr, err = g.svc.UpdateDraft(l.Id, raw); err != nil {
+			if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+				// Deleted in Gmail meanwhile; keep the edits.
+				dr, err = g.svc.CreateDraft(raw)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if l.Id != "" {
+			// Drop the copy the edited file replaces.
+			if s, ok, err := g.cache.GetDraft(l.Id); err != nil {
+				return err
+			} else if ok && s.Key != l.Key {
+				removeDraftFile(d, s.Key)
+			}
+			if l.Id != dr.Id {
+				if err := g.cache.DelDraft(l.Id); err != nil {
+					return err
+				}
+			}
+		}
+		if err := g.storeDraft(d, dr.Id, dr.Message.Id, raw, l.Key); err != nil {
+			return err
+		}
+	}
+	if len(changed) > 0 {
+		log.Println("Uploaded", len(changed), "drafts")
+	}
+	return nil
+}
+
+// pullDrafts downloads the drafts that are new or changed in Gmail, and
+// removes those that are gone.
+func (g *Gmail) pullDrafts(d maildir.Maildir) error {
+	seen := make(map[string]struct{})
+	page := ""
+	for {
+		r, err := g.svc.GetDrafts(page)
+		if err != nil {
+			return err
+		}
+		for _, dr := range r.Drafts {
+			seen[dr.Id] = struct{}{}
+			if err := g.pullDraft(d, dr); err != nil {
+				return err
+			}
+		}
+		page = r.NextPageToken
+		if page == "" {
+			break
+		}
+	}
+	ds := make(chan string)
+	ids, err := collectItems(ds, g.cache.GetDrafts(ds))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		s, _, err := g.cache.GetDraft(id)
+		if err != nil {
+			return err
+		}
+		removeDraftFile(d, s.Key)
+		if err := g.cache.DelDraft(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullDraft downloads draft dr, unless its file is up to date.
+func (g *Gmail) pullDraft(d maildir.Maildir, dr *gmail.Draft) error {
+	s, ok, err := g.cache.GetDraft(dr.Id)
+	if err != nil {
+		return err
+	}
+	if ok && s.MsgId == dr.Message.Id {
+		if _, err := d.GetFile(s.Key); err == nil {
+			return nil
+		}
+	}
+	body, err := g.svc.GetRawMessage(dr.Message.Id)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+		// Edited or sent since it was listed.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer body.Close()
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return g.storeDraft(d, dr.Id, dr.Message.Id, raw, s.Key)
+}
+
+// storeDraft delivers raw to d as draft id, whose message is msgId, replacing
+// the file old, if any.
+func (g *Gmail) storeDraft(d maildir.Maildir, id, msgId string, raw []byte, old maildir.Key) error {
+	raw = spliceHeader(raw, draftIdHeader, []string{id})
+	k, err := d.DeliverRaw(bytes.NewReader(raw), draftFlags)
+	if err != nil {
+		return err
+	}
+	if old != "" {
+		removeDraftFile(d, old)
+	}
+	sum := sha256.Sum256(raw)
+	return g.cache.SetDraft(id, draftState{MsgId: msgId, Key: k, Sha256: hex.EncodeToString(sum[:])})
+}
+
+// removeDraftFile removes the file of a draft, if the mail reader hasn't
+// already.
+func removeDraftFile(d maildir.Maildir, k maildir.Key) {
+	if _, err := d.GetFile(k); err != nil {
+		return
+	}
+	if err := d.Delete(k); err != nil {
+		log.Println("Error removing draft", k, err)
+	}
+}
@@ -0,0 +1,234 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// dumpFormat identifies cache dumps, and dumpVersion the layout of their
+	// records.
+	dumpFormat  = "outtake-cache"
+	dumpVersion = 1
+)
+
+// dumpHeader is the first line of a cache dump.
+type dumpHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	// Schema is the cache schema version the values were read from.
+	Schema uint64 `json:"schema"`
+}
+
+// dumpRecord is a single cache entry. Value holds the decoded value for the
+// namespaces we know; Raw holds the bytes of any other namespace.
+type dumpRecord struct {
+	Ns    string          `json:"ns"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Raw   []byte          `json:"raw,omitempty"`
+}
+
+// valueCodec converts a namespace's cache values to and from JSON.
+type valueCodec struct {
+	decode func([]byte) (interface{}, error)
+	encode func(json.RawMessage) ([]byte, error)
+}
+
+var stringCodec = valueCodec{
+	decode: func(bs []byte) (interface{}, error) { return string(bs), nil },
+	encode: func(js json.RawMessage) ([]byte, error) {
+		var s string
+		err := json.Unmarshal(js, &s)
+		return []byte(s), err
+	},
+}
+
+var stringsCodec = valueCodec{
+	decode: func(bs []byte) (interface{}, error) { return decodeStrings(bs) },
+	encode: func(js json.RawMessage) ([]byte, error) {
+		var ss []string
+		if err := json.Unmarshal(js, &ss); err != nil {
+			return nil, err
+		}
+		return encodeStrings(ss)
+	},
+}
+
+var uvarintCodec = valueCodec{
+	decode: func(bs []byte) (interface{}, error) {
+		v, _ := binary.Uvarint(bs)
+		return v, nil
+	},
+	encode: func(js json.RawMessage) ([]byte, error) {
+		var v uint64
+		if err := json.Unmarshal(js, &v); err != nil {
+			return nil, err
+		}
+		b := make([]byte, binary.MaxVarintLen64)
+		binary.PutUvarint(b, v)
+		return b, nil
+	},
+}
+
+// Labels only record membership, so they have no value.
+var emptyCodec = valueCodec{
+	decode: func([]byte) (interface{}, error) { return nil, nil },
+	encode: func(json.RawMessage) ([]byte, error) { return []byte{}, nil },
+}
+
+var tokenCodec = valueCodec{
+	decode: func(bs []byte) (interface{}, error) {
+		var tok oauth2.Token
+		err := gob.NewDecoder(bytes.NewBuffer(bs)).Decode(&tok)
+		return &tok, err
+	},
+	encode: func(js json.RawMessage) ([]byte, error) {
+		var tok oauth2.Token
+		if err := json.Unmarshal(js, &tok); err != nil {
+			return nil, err
+		}
+		bs := new(bytes.Buffer)
+		err := gob.NewEncoder(bs).Encode(&tok)
+		return bs.Bytes(), err
+	},
+}
+
+var namespaceCodecs = map[string]valueCodec{
+	midToKey:        stringCodec,
+	gidToMid:        stringCodec,
+	midToLabels:     stringsCodec,
+	midToGid:        stringsCodec,
+	midToSize:       uvarintCodec,
+	midToSha256:     stringCodec,
+	midToDate:       uvarintCodec,
+	midToThread:     stringCodec,
+	threadToMids:    stringsCodec,
+	draftToMid:      stringCodec,
+	draftToKey:      stringCodec,
+	draftToSha256:   stringCodec,
+	excludedMids:    emptyCodec,
+	retentionPolicy: stringCodec,
+	historyIndex:    uvarintCodec,
+	schemaNs:        uvarintCodec,
+	oauthToken:      tokenCodec,
+	oauthScopes:     stringsCodec,
+}
+
+func codecFor(ns string) (valueCodec, bool) {
+	if strings.HasPrefix(ns, labelToGidPrefix) {
+		return emptyCodec, true
+	}
+	c, ok := namespaceCodecs[ns]
+	return c, ok
+}
+
+// DumpCache writes every entry of the cache in dir to w, as a header line
+// followed by one JSON record per line. The OAuth token is left out unless
+// withToken is set.
+func DumpCache(dir string, w io.Writer, withToken bool) error {
+	c, err := openGmailCache(dir)
+	if err != nil {
+		return err
+	}
+	defer c.Cache.Close()
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(dumpHeader{dumpFormat, dumpVersion, schemaVersion}); err != nil {
+		return err
+	}
+	nss, err := c.Cache.Namespaces()
+	if err != nil {
+		return err
+	}
+	for _, ns := range nss {
+		if ns == oauthToken && !withToken {
+			continue
+		}
+		ks := make(chan string)
+		keys, err := collectItems(ks, c.Cache.Items(ns, ks))
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			v, ok, err := c.Cache.Get(ns, k)
+			if err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			r := dumpRecord{Ns: ns, Key: k}
+			if codec, ok := codecFor(ns); !ok {
+				r.Raw = v
+			} else if d, err := codec.decode(v); err != nil {
+				return fmt.Errorf("decoding %s/%s: %v", ns, k, err)
+			} else if d != nil {
+				if r.Value, err = json.Marshal(d); err != nil {
+					return err
+				}
+			}
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LoadCache reads a dump written by DumpCache into the cache in dir, which
+// must be empty. Nothing is written unless the whole dump can be read.
+func LoadCache(dir string, r io.Reader) error {
+	c, err := openGmailCache(dir)
+	if err != nil {
+		return err
+	}
+	defer c.Cache.Close()
+	if empty, err := c.isEmpty(); err != nil {
+		return err
+	} else if !empty {
+		return fmt.Errorf("the cache in %s isn't empty", dir)
+	}
+	s := bufio.NewScanner(r)
+	// Label lists and tokens can make for long lines.
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("empty cache dump")
+	}
+	var h dumpHeader
+	if err := json.Unmarshal(s.Bytes(), &h); err != nil || h.Format != dumpFormat {
+		return fmt.Errorf("not a cache dump")
+	} else if h.Version != dumpVersion {
+		return fmt.Errorf("unsupported cache dump version %d", h.Version)
+	} else if h.Schema != schemaVersion {
+		return fmt.Errorf("cache dump has schema version %d, but this version of outtake uses %d", h.Schema, schemaVersion)
+	}
+	return c.Batch(func(tc *gmailCache) error {
+		for line := 2; s.Scan(); line++ {
+			var rec dumpRecord
+			if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			v := append([]byte{}, rec.Raw...)
+			if codec, ok := codecFor(rec.Ns); ok {
+				var err error
+				if v, err = codec.encode(rec.Value); err != nil {
+					return fmt.Errorf("line %d: %v", line, err)
+				}
+			}
+			if err := tc.Cache.Set(rec.Ns, rec.Key, v); err != nil {
+				return err
+			}
+		}
+		return s.Err()
+	})
+}
@@ -0,0 +1,483 @@
+package gmail
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meelapshah/outtake/lib"
+)
+
+// Export formats.
+const (
+	MboxFormat = "mbox"
+	EmlFormat  = "eml"
+	TarFormat  = "tar"
+	ZipFormat  = "zip"
+)
+
+// exportLabelsHeader carries the labels of exported messages, by name, as in
+// Google Takeout.
+const exportLabelsHeader = "X-Gmail-Labels"
+
+// ExportOptions selects the messages to export and how to write them.
+type ExportOptions struct {
+	// Format is MboxFormat, EmlFormat, TarFormat or ZipFormat.
+	Format string
+	// Only messages with all of Labels, given by name or ID, are exported.
+	Labels []string
+	// Only messages received at or after After and before Before are
+	// exported, unless they are zero.
+	After, Before time.Time
+	// Query further filters messages, with terms like Gmail's search:
+	// label:, -label:, is:unread, is:starred, larger:, smaller:, after:,
+	// before: and rfc822msgid:.
+	Query string
+}
+
+// exportFilter is the combination of the options and the query of an export.
+type exportFilter struct {
+	labels, notLabels []string
+	larger, smaller   int64
+	after, before     time.Time
+	msgId             string
+}
+
+// ParseSize parses a size like Gmail's larger:, e.g. 100, 10k or 5M.
+func ParseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult, s = 1<<10, s[:len(s)-1]
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		mult, s = 1<<20, s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * mult, err
+}
+
+// ParseDate parses a date as written in queries, e.g. 2006/01/02 or
+// 2006-01-02, in local time.
+func ParseDate(s string) (time.Time, error) {
+	return time.ParseInLocation("2006/01/02", strings.Replace(s, "-", "/", -1), time.Local)
+}
+
+// parseQuery adds the terms of query q to f.
+func (f *exportFilter) parseQuery(q string) error {
+	for _, term := range strings.Fields(q) {
+		kv := strings.SplitN(term, ":", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("bad query term %q", term)
+		}
+		var err error
+		switch v := kv[1]; strings.ToLower(kv[0]) {
+		case "label":
+			f.labels = append(f.labels, v)
+		case "-label":
+			f.notLabels = append(f.notLabels, v)
+		case "is":
+			switch strings.ToLower(v) {
+			case "unread":
+				f.labels = append(f.labels, unreadLabel)
+			case "starred":
+				f.labels = append(f.labels, flaggedLabel)
+			default:
+				return fmt.Errorf("bad query term %q", term)
+			}
+		case "larger":
+			f.larger, err = ParseSize(v)
+		case "smaller":
+			f.smaller, err = ParseSize(v)
+		case "after":
+			f.after, err = ParseDate(v)
+		case "before":
+			f.before, err = ParseDate(v)
+		case "rfc822msgid":
+			f.msgId = strings.Trim(v, "<>")
+		default:
+			return fmt.Errorf("unknown query term %q", term)
+		}
+		if err != nil {
+			return fmt.Errorf("bad query term %q: %v", term, err)
+		}
+	}
+	return nil
+}
+
+// hasLabel reports whether the label IDs ls include l, given by name or ID.
+func hasLabel(ls []string, l string, names map[string]string) bool {
+	for _, id := range ls {
+		if id == l || names[id] == l {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCached reports whether a message matches the parts of the filter that
+// only need the cache.
+func (f *exportFilter) matchCached(labels []string, size int64, mId string, names map[string]string) bool {
+	for _, l := range f.labels {
+		if !hasLabel(labels, l, names) {
+			return false
+		}
+	}
+	for _, l := range f.notLabels {
+		if hasLabel(labels, l, names) {
+			return false
+		}
+	}
+	if (f.larger > 0 && size <= f.larger) || (f.smaller > 0 && size >= f.smaller) {
+		return false
+	}
+	return f.msgId == "" || f.msgId == mId
+}
+
+func (f *exportFilter) matchDate(t time.Time) bool {
+	return (f.after.IsZero() || !t.Before(f.after)) && (f.before.IsZero() || t.Before(f.before))
+}
+
+// exportedMsg is a message being exported.
+type exportedMsg struct {
+	name string // File name in eml, tar and zip exports.
+	from string
+	date time.Time
+	r    io.Reader
+}
+
+// archiveWriter writes exported messages in one of the export formats.
+type archiveWriter interface {
+	add(m exportedMsg) error
+	Close() error
+}
+
+// mboxWriter writes mboxrd: each message follows a "From " line, with lines
+// starting with any number of ">" then "From " quoted by one more ">".
+type mboxWriter struct {
+	w *bufio.Writer
+	c io.Closer
+}
+
+func (w *mboxWriter) add(m exportedMsg) error {
+	fmt.Fprintf(w.w, "From %s %s\n", m.from, m.date.UTC().Format(time.ANSIC))
+	r := bufio.NewReader(m.r)
+	bol := true // Whether we're at the start of a line.
+	for {
+		line, err := r.ReadSlice('\n')
+		if bol && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			w.w.WriteByte('>')
+		}
+		bol = err == nil
+		if bol {
+			line = append(bytes.TrimRight(line, "\r\n"), '\n')
+		}
+		w.w.Write(line)
+		if err == io.EOF {
+			if len(line) > 0 {
+				w.w.WriteByte('\n')
+			}
+			break
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	_, err := w.w.WriteString("\n")
+	return err
+}
+
+func (w *mboxWriter) Close() error {
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.c.Close()
+}
+
+// emlWriter writes each message to its own file in a directory.
+type emlWriter struct {
+	dir string
+}
+
+func (w *emlWriter) add(m exportedMsg) error {
+	fn := path.Join(w.dir, m.name)
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, m.r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(fn, m.date, m.date)
+}
+
+func (w *emlWriter) Close() error {
+	return nil
+}
+
+// tarWriter writes a tar archive. The size of each message must be known
+// before it is written, so messages are spooled to a temporary file first.
+type tarWriter struct {
+	tw    *tar.Writer
+	c     io.Closer
+	spool *os.File
+}
+
+func (w *tarWriter) add(m exportedMsg) error {
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	} else if err := w.spool.Truncate(0); err != nil {
+		return err
+	}
+	n, err := io.Copy(w.spool, m.r)
+	if err != nil {
+		return err
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := &tar.Header{Name: m.name, Mode: 0600, Size: n, ModTime: m.date}
+	if err := w.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err = io.CopyN(w.tw, w.spool, n)
+	return err
+}
+
+func (w *tarWriter) Close() error {
+	w.spool.Close()
+	os.Remove(w.spool.Name())
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	return w.c.Close()
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+	c  io.Closer
+}
+
+func (w *zipWriter) add(m exportedMsg) error {
+	f, err := w.zw.CreateHeader(&zip.FileHeader{Name: m.name, Method: zip.Deflate, Modified: m.date})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, m.r)
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	return w.c.Close()
+}
+
+// newArchiveWriter creates the export out in format: a directory for
+// EmlFormat, otherwise a file, or standard output if out is "-".
+func newArchiveWriter(format, out string) (archiveWriter, error) {
+	if format == EmlFormat {
+		if err := os.MkdirAll(out, 0700); err != nil {
+			return nil, err
+		}
+		return &emlWriter{out}, nil
+	}
+	var f io.WriteCloser = os.Stdout
+	if out != "-" {
+		var err error
+		if f, err = os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return nil, err
+		}
+	}
+	switch format {
+	case MboxFormat:
+		return &mboxWriter{bufio.NewWriter(f), f}, nil
+	case TarFormat:
+		spool, err := ioutil.TempFile("", "outtake-export")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &tarWriter{tar.NewWriter(f), f, spool}, nil
+	case ZipFormat:
+		return &zipWriter{zip.NewWriter(f), f}, nil
+	}
+	f.Close()
+	return nil, fmt.Errorf("unknown export format %q, expected mbox, eml, tar or zip", format)
+}
+
+// joinLabelNames joins label names into an X-Gmail-Labels value, quoting
+// names with commas or quotes as Takeout does, so that they can be split
+// again as CSV.
+func joinLabelNames(names []string) string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		if strings.ContainsAny(n, ",\"") || strings.TrimSpace(n) != n {
+			n = `"` + strings.Replace(n, `"`, `""`, -1) + `"`
+		}
+		quoted[i] = n
+	}
+	return strings.Join(quoted, ",")
+}
+
+// labelNames maps label IDs to their names, or is empty if Gmail can't be
+// reached.
+func (g *Gmail) labelNames() map[string]string {
+	names := make(map[string]string)
+	ls, err := g.svc.GetLabels()
+	if err != nil {
+		log.Println("Couldn't get label names, exporting label IDs:", err)
+		return names
+	}
+	for _, l := range ls.Labels {
+		names[l.Id] = l.Name
+	}
+	return names
+}
+
+// messageDate returns when message id, with header h, was received: the
+// internal date in the cache, else its X-GM-Internal-Date, else its Date,
+// else the modification time of its file, which is set to the former at
+// delivery.
+func (g *Gmail) messageDate(id string, h mail.Header, fn string) (time.Time, error) {
+	if t, ok, err := g.cache.GetMsgDate(id); err != nil || ok {
+		return t, err
+	}
+	return headerDate(h, fn), nil
+}
+
+// headerDate returns when the message with header h was received according
+// to the message itself or, failing that, its file fn.
+func headerDate(h mail.Header, fn string) time.Time {
+	if t, err := time.Parse(time.RFC1123Z, h.Get(internalDateHeader)); err == nil {
+		return t
+	} else if t, err := h.Date(); err == nil {
+		return t
+	} else if fi, err := os.Stat(fn); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// envelopeSender returns the address for the "From " line of an mbox.
+func envelopeSender(h mail.Header) string {
+	for _, f := range []string{"Return-Path", "From"} {
+		if a, err := mail.ParseAddress(h.Get(f)); err == nil && a.Address != "" {
+			return strings.Replace(a.Address, " ", "_", -1)
+		}
+	}
+	return "MAILER-DAEMON"
+}
+
+// Export writes the messages in the maildir matching opts to out, with their
+// labels in an X-Gmail-Labels header, and returns how many it wrote. out is
+// a directory for EmlFormat, and otherwise a file, "-" meaning standard
+// output.
+func (g *Gmail) Export(out string, opts ExportOptions, progress chan<- lib.Progress) (int, error) {
+	f := exportFilter{labels: opts.Labels, after: opts.After, before: opts.Before}
+	if err := f.parseQuery(opts.Query); err != nil {
+		return 0, err
+	}
+	w, err := newArchiveWriter(opts.Format, out)
+	if err != nil {
+		return 0, err
+	}
+	names := g.labelNames()
+	is := make(chan string)
+	ids, err := collectItems(is, g.cache.GetMsgs(is))
+	if err != nil {
+		w.Close()
+		return 0, err
+	}
+	n := 0
+	for i, id := range ids {
+		if progress != nil {
+			progress <- lib.Progress{Current: uint(i), Total: uint(len(ids))}
+		}
+		if ok, err := g.exportMsg(w, &f, id, names); err != nil {
+			w.Close()
+			return n, fmt.Errorf("exporting %s: %v", id, err)
+		} else if ok {
+			n++
+		}
+	}
+	return n, w.Close()
+}
+
+// exportMsg writes message id to w if it matches f.
+func (g *Gmail) exportMsg(w archiveWriter, f *exportFilter, id string, names map[string]string) (bool, error) {
+	labels, _, err := g.cache.GetMsgLabels(id)
+	if err != nil {
+		return false, err
+	}
+	d, _, err := g.cache.GetMsgDigest(id)
+	if err != nil {
+		return false, err
+	}
+	mId, _, err := g.cache.GetMessageIdForGmailId(id)
+	if err != nil {
+		return false, err
+	}
+	if !f.matchCached(labels, d.Size, mId, names) {
+		return false, nil
+	}
+	k, ok, err := g.cache.GetMsgKey(id)
+	if err != nil || !ok {
+		return false, err
+	}
+	fn, err := g.dir.GetFile(k)
+	if err != nil {
+		log.Println("Not exporting", id, ":", err)
+		return false, nil
+	}
+	r, err := g.dir.OpenFile(fn)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	h, err := readHeaderBlock(br)
+	if err != nil {
+		return false, err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(h))
+	if err != nil {
+		log.Println("Not exporting", id, ":", err)
+		return false, nil
+	}
+	date, err := g.messageDate(id, m.Header, fn)
+	if err != nil {
+		return false, err
+	}
+	if !f.matchDate(date) {
+		return false, nil
+	}
+	var ls []string
+	for _, l := range labels {
+		if name, ok := names[l]; ok {
+			l = name
+		}
+		ls = append(ls, l)
+	}
+	h = spliceHeader(h, exportLabelsHeader, []string{joinLabelNames(ls)})
+	return true, w.add(exportedMsg{
+		name: id + ".eml",
+		from: envelopeSender(m.Header),
+		date: date,
+		r:    io.MultiReader(bytes.NewReader(h), br),
+	})
+}
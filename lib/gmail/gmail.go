@@ -10,38 +10,43 @@
 //
 // To abstract this a bit, and to parallelize slower network operations, our
 // flow looks like this:
-//     full() --> getBody() --> getMetaData() --> writeAdd()
+//     full() --> getMetaData() --> getBody() --> writeAdd()
 //            --> getMetaData() --> writeLabels()
 //            --> writeDel()
 //
-//     incremental() --> getBody() --> getMetaData() --> writeAdd()
+//     incremental() --> getMetaData() --> getBody() --> writeAdd()
 //                   --> writeLabels()
 //                   --> writeDel()
 // getBody() and getMetaData() make RPCs to the Gmail API, and multiple
-// workers run in parallel.
+// workers run in parallel. getBody() streams the message straight into the
+// maildir, so only its header is held in memory; writeAdd() then records it
+// in the cache.
 
 package gmail
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/base64"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"log"
 	"net/mail"
 	"os"
 	"os/exec"
-	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/meelapshah/outtake/lib"
 	"github.com/meelapshah/outtake/lib/maildir"
-	"github.com/meelapshah/outtake/lib/oauth"
 	nm "github.com/zenhack/go.notmuch"
-	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	gmail "google.golang.org/api/gmail/v1"
 	"google.golang.org/api/googleapi"
@@ -50,6 +55,11 @@ import (
 const (
 	// What X- header to use for storing labels.
 	labelsHeader = "X-Keywords"
+	// Headers carrying the Gmail message and thread IDs, in decimal as used by
+	// IMAP, and the time Gmail received the message.
+	gmailIdHeader      = "X-GM-MSGID"
+	threadIdHeader     = "X-GM-THRID"
+	internalDateHeader = "X-GM-Internal-Date"
 	// Cache filename.
 	cacheFile = ".outtake"
 
@@ -72,89 +82,132 @@ var (
 var (
 	// Errors.
 	unknownMessage   = errors.New("unknown message")
+	badMessage       = errors.New("unparseable message")
 	fullSyncRequired = errors.New("full sync required")
 	// Parallelism.
 	MessageBufferSize   = 128
 	ConcurrentDownloads = 8
+	// Approximate number of bytes of messages downloaded at once.
+	MemoryBudget int64 = 256 << 20
+	// Maximum number of operations committed to the cache at once.
+	CacheBatchSize = 256
+	// Whether to record Gmail message and thread IDs in delivered messages.
+	WriteGmailHeaders = false
+	// Whether syncing a label also syncs the other messages of the threads
+	// it labels, e.g. replies that aren't labeled.
+	SyncThreads = false
+	// Whether drafts are synced to the drafts folder by SyncDrafts, rather
+	// than with the other messages.
+	SyncDrafts = false
+	// Messages larger than this, by Gmail's estimate, are stored with their
+	// attachments replaced by placeholders. 0 means no limit.
+	MaxMessageSize int64 = 0
+	// The retention policy: only messages newer than a date or age, e.g.
+	// "2006-01-02" or "12m", and only the most recent RetainPerLabel messages
+	// of each label are kept locally. Empty and 0 mean no limit.
+	RetainNewerThan = ""
+	RetainPerLabel  = 0
+	// How to compress delivered messages: "", "gzip" or "zstd".
+	Compression = ""
+	// age recipients to encrypt delivered messages to, and the file of
+	// identities to decrypt them with, if any.
+	EncryptTo    []string
+	IdentityFile string
+	// Where the cache is stored: BoltBackend or SQLiteBackend.
+	CacheBackend = BoltBackend
+	// How long SQLite cache operations wait for another process's batch to
+	// release the write lock before failing with SQLITE_BUSY.
+	SQLiteBusyTimeout = 10 * time.Second
 )
 
 // Gmail represents a Gmail client.
 type Gmail struct {
 	label    string
 	labelId  string
+	features Features
 	cache    gmailCache
 	svc      gmailService
+	budget   *lib.ByteBudget
 	dir      maildir.Maildir
 	progress chan<- lib.Progress
+	// Messages received before this are left out, if it isn't zero.
+	retainSince time.Time
 }
 
-// Creates a new Gmail synchronizer.
-func NewGmail(dir string, label string) (*Gmail, error) {
+// Creates a new Gmail synchronizer. Only the OAuth scopes needed for features
+// are requested.
+func NewGmail(dir string, label string, features Features) (*Gmail, error) {
 	g := Gmail{
-		label: label,
+		label:    label,
+		features: features,
+		budget:   lib.NewByteBudget(MemoryBudget),
 	}
-	f := path.Join(dir, cacheFile)
-	if c, err := lib.NewBoltCache(f); err != nil {
+	if c, err := openGmailCache(dir); err != nil {
 		return nil, err
 	} else {
-		g.cache = gmailCache{c}
-	}
-	cfg := &oauth2.Config{
-		ClientID:     oauth.ClientId,
-		ClientSecret: oauth.Secret,
-		Scopes:       []string{gmail.MailGoogleComScope},
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-			TokenURL: "https://accounts.google.com/o/oauth2/token",
-		},
-	}
-	tok, ok := g.cache.GetOauthToken()
-	if !ok {
-		// XXX: should we use a client-specified context here?
-		var err error
-		tok, err = oauth.GetOAuthClient(context.TODO(), cfg)
-		if err != nil {
-			return nil, err
-		}
-		g.cache.SetOauthToken(tok)
+		g.cache = *c
+	}
+	cfg, tok, err := g.authorize()
+	if err != nil {
+		return nil, err
 	}
 	clt := cfg.Client(oauth2.NoContext, tok)
 	if c, err := gmail.New(clt); err != nil {
 		return nil, err
 	} else {
-		g.svc = newRestGmailService(gmail.NewUsersService(c))
+		g.svc = newRestGmailService(clt, gmail.NewUsersService(c))
+	}
+	c, err := maildir.ParseCompression(Compression)
+	if err != nil {
+		return nil, err
+	}
+	rs, ids, err := maildir.LoadKeys(EncryptTo, IdentityFile)
+	if err != nil {
+		return nil, err
 	}
 	if d, err := maildir.Create(dir); err != nil {
 		return nil, err
 	} else {
-		g.dir = d
+		g.dir = d.WithCompression(c).WithEncryption(rs, ids)
 	}
 
 	return &g, nil
 }
 
+// Close releases the cache.
+func (g *Gmail) Close() error {
+	return g.cache.Cache.Close()
+}
+
 const (
 	NONE         = iota
 	ADD          = iota
 	DELETE       = iota
 	WRITE_LABELS = iota
+	// MATCH records that the message with Key is already in the maildir.
+	MATCH = iota
+	// SET_THREAD only records the thread of a message.
+	SET_THREAD = iota
+	// EXCLUDE records that a message is left out by the retention policy.
+	EXCLUDE = iota
 )
 
 type msgOp struct {
-	Id        string
-	HistoryId uint64
-	Labels    []string
-	Msg       *mail.Message
-	Operation int32
-	Error     error
+	Id           string
+	ThreadId     string
+	HistoryId    uint64
+	InternalDate int64 // Milliseconds since the epoch.
+	Size         int64 // Gmail's size estimate.
+	Labels       []string
+	Msg          *mail.Message
+	Key          maildir.Key
+	Sha256       string // Of the delivered file, for ADD.
+	Operation    int32
+	Error        error
 }
 
 func (g *Gmail) getMaildirMessage(k maildir.Key) (*mail.Message, io.ReadCloser, error) {
-	fn, err := g.dir.GetFile(k)
-	if err != nil {
-		return nil, nil, err
-	}
-	f, err := os.Open(fn)
+	f, err := g.dir.Open(k)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -162,31 +215,84 @@ func (g *Gmail) getMaildirMessage(k maildir.Key) (*mail.Message, io.ReadCloser,
 	return m, f, err
 }
 
-func (g *Gmail) deliverMessage(m *mail.Message) (maildir.Key, error) {
-	labels := m.Header[labelsHeader]
+// deliverStream writes the message read from r to maildir d with the given
+// labels, applying edits to its header on the way; only the header is held
+// in memory. The file is dated at date, unless it is zero. It returns the new
+// key, the edited header, and the SHA-256 of the file. Messages whose header
+// can't be parsed fail with badMessage.
+func (g *Gmail) deliverStream(d maildir.Maildir, r io.Reader, labels []string, edits []headerEdit, date time.Time) (maildir.Key, *mail.Message, string, error) {
+	br := bufio.NewReader(r)
+	h, err := readHeaderBlock(br)
+	if err != nil {
+		return "", nil, "", err
+	}
+	for _, e := range edits {
+		h = spliceHeader(h, e.name, e.vs)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(h))
+	if err != nil {
+		return "", nil, "", badMessage
+	}
+	flags := ""
 	if lib.Contains(labels, sentLabel) || !lib.Contains(labels, unreadLabel) {
-		return g.dir.DeliverCur(m)
-	} else {
-		return g.dir.DeliverNew(m)
+		// Add the maildir seen flag to messages delivered to the cur folder
+		flags = "S"
 	}
+	sum := sha256.New()
+	k, err := d.DeliverRawAt(io.TeeReader(io.MultiReader(bytes.NewReader(h), br), sum), flags, date)
+	if err != nil {
+		return "", nil, "", err
+	}
+	return k, m, hex.EncodeToString(sum.Sum(nil)), nil
 }
 
-func (g *Gmail) getBody(m string) (*mail.Message, error) {
-	body, err := g.svc.GetRawMessage(m)
-	if err != nil {
-		return nil, err
+// getBody downloads message o and delivers it to the maildir, with its labels
+// and, if enabled, its Gmail IDs added to the header. Its metadata must have
+// been fetched already. Up to MemoryBudget bytes of messages are downloaded
+// at once, according to Gmail's size estimates. Messages larger than
+// MaxMessageSize are stored without their attachments.
+func (g *Gmail) getBody(o *msgOp) error {
+	g.budget.Acquire(o.Size)
+	defer g.budget.Release(o.Size)
+	var body io.ReadCloser
+	var err error
+	if MaxMessageSize > 0 && o.Size > MaxMessageSize {
+		body, err = g.getStripped(o)
+	} else {
+		body, err = g.svc.GetRawMessage(o.Id)
 	}
-	raw, err := base64.URLEncoding.DecodeString(body)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	defer body.Close()
+	k, m, sum, err := g.deliverStream(g.dir, body, o.Labels, g.headerEdits(o), internalTime(o.InternalDate))
 	if err != nil {
-		log.Println("Error parsing message", m, ":", err)
-		// XXX: Don't return an error here. These are often chats and such, due to bugs in the Gmail API.
-		return nil, nil
+		return err
+	}
+	o.Key, o.Msg, o.Sha256 = k, m, sum
+	return nil
+}
+
+// headerEdits returns the edits made to the header of message o as it is
+// delivered: its labels and, if enabled, its Gmail IDs.
+func (g *Gmail) headerEdits(o *msgOp) []headerEdit {
+	edits := []headerEdit{{labelsHeader, o.Labels}}
+	if WriteGmailHeaders {
+		edits = append(edits, gmailHeaders(o)...)
+	} else if SyncThreads && o.ThreadId != "" {
+		// Let mail readers thread messages as Gmail does.
+		edits = append(edits, headerEdit{threadIdHeader, []string{formatGmailIdHeader(o.ThreadId)}})
 	}
-	return msg, nil
+	return edits
+}
+
+// internalTime converts a Gmail internalDate, in milliseconds since the
+// epoch, to a time. Missing dates give the zero time.
+func internalTime(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
 
 func (g *Gmail) getMetaData(m *msgOp) error {
@@ -196,56 +302,163 @@ func (g *Gmail) getMetaData(m *msgOp) error {
 	}
 	m.Labels = meta.LabelIds
 	m.HistoryId = meta.HistoryId
+	m.ThreadId = meta.ThreadId
+	m.InternalDate = meta.InternalDate
+	m.Size = meta.SizeEstimate
 	return err
 }
 
-func (g *Gmail) writeAdd(m msgOp) error {
-	k, err := g.deliverMessage(m.Msg)
+// formatGmailIdHeader converts a hex Gmail API ID to the decimal form used
+// in X-GM-MSGID and X-GM-THRID headers.
+func formatGmailIdHeader(id string) string {
+	n, err := strconv.ParseUint(id, 16, 64)
 	if err != nil {
+		return id
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+// gmailHeaders returns the header edits recording the Gmail IDs and internal
+// date of o.
+func gmailHeaders(o *msgOp) []headerEdit {
+	edits := []headerEdit{{gmailIdHeader, []string{formatGmailIdHeader(o.Id)}}}
+	if o.ThreadId != "" {
+		edits = append(edits, headerEdit{threadIdHeader, []string{formatGmailIdHeader(o.ThreadId)}})
+	}
+	if o.InternalDate > 0 {
+		t := internalTime(o.InternalDate)
+		edits = append(edits, headerEdit{internalDateHeader, []string{t.Format(time.RFC1123Z)}})
+	}
+	return edits
+}
+
+// batch is a group of operations whose cache updates are committed together.
+type batch struct {
+	cache *gmailCache
+	// Maildir messages that can be removed once the batch is committed.
+	stale []maildir.Key
+	// Maildir messages delivered by the batch, to remove if it fails.
+	delivered []maildir.Key
+}
+
+// writeBatch runs f in a single cache transaction, and removes the maildir
+// messages f made stale once the transaction has been committed. If f fails,
+// none of its cache updates are kept, the messages it delivered are removed
+// and the stale messages are left alone.
+func (g *Gmail) writeBatch(f func(b *batch) error) error {
+	b := batch{}
+	if err := g.cache.Batch(func(c *gmailCache) error {
+		b.cache = c
+		return f(&b)
+	}); err != nil {
+		for _, k := range b.delivered {
+			if err := g.dir.Delete(k); err != nil {
+				log.Println("Couldn't delete message", k, ":", err)
+			}
+		}
 		return err
 	}
+	for _, k := range b.stale {
+		if err := g.dir.Delete(k); err != nil {
+			log.Println("Couldn't delete message", k, ":", err)
+		}
+	}
+	return nil
+}
+
+// writeAdd records message m, already delivered by getBody, in the cache.
+func (g *Gmail) writeAdd(b *batch, m msgOp) error {
+	k := m.Key
 	// Update the cache.
-	g.cache.SetMsgLabels(m.Id, m.Labels)
-	g.cache.SetMsgKey(m.Id, k)
-	if mId, ok := getMessageId(m.Msg); ok {
-		g.cache.SetIds(m.Id, mId)
+	if err := b.cache.SetMsgLabels(m.Id, m.Labels); err != nil {
+		return err
 	}
+	if err := b.cache.SetMsgKey(m.Id, k); err != nil {
+		return err
+	}
+	if err := g.setDigest(b, m.Id, m.Sha256, m.Size); err != nil {
+		return err
+	}
+	if m.InternalDate > 0 {
+		if err := b.cache.SetMsgDate(m.Id, m.InternalDate); err != nil {
+			return err
+		}
+	}
+	if mId, err := g.messageIdForKey(k, m.Msg); err != nil {
+		return err
+	} else if err := b.cache.SetIds(m.Id, mId); err != nil {
+		return err
+	}
+	return setGmailLabels(b, m.Id, m.Labels)
+}
+
+// setGmailLabels records in the cache which of the labels mirrored as notmuch
+// tags message id has.
+func setGmailLabels(b *batch, id string, labels []string) error {
 	for _, lbl := range gmailLabels {
-		if lib.Contains(m.Labels, lbl) {
-			g.cache.SetGmailLabel(lbl, m.Id)
-		} else if !lib.Contains(m.Labels, lbl) {
-			g.cache.DelGmailLabel(lbl, m.Id)
+		var err error
+		if lib.Contains(labels, lbl) {
+			err = b.cache.SetGmailLabel(lbl, id)
+		} else {
+			err = b.cache.DelGmailLabel(lbl, id)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (g *Gmail) writeDel(id string) error {
-	k, ok := g.cache.GetMsgKey(id)
-	if !ok {
+// recordDigest records the hash of message id's file k in the cache, and its
+// size on the server if known.
+func (g *Gmail) recordDigest(b *batch, id string, k maildir.Key, size int64) error {
+	sum, err := g.sha256File(k)
+	if err != nil {
+		return err
+	}
+	return g.setDigest(b, id, sum, size)
+}
+
+// setDigest records the hash sum of message id's file, and its size on the
+// server if known.
+func (g *Gmail) setDigest(b *batch, id, sum string, size int64) error {
+	if size > 0 {
+		if err := b.cache.SetMsgSize(id, size); err != nil {
+			return err
+		}
+	}
+	return b.cache.SetMsgSha256(id, sum)
+}
+
+func (g *Gmail) writeDel(b *batch, id string) error {
+	if err := b.cache.DelExcluded(id); err != nil {
+		return err
+	}
+	k, ok, err := b.cache.GetMsgKey(id)
+	if err != nil {
+		return err
+	} else if !ok {
 		// XXX: It doesn't make sense to error out here, since we're deleting anyway...
 		return nil
 	}
-	if err := g.dir.Delete(k); err != nil {
+	if err := b.cache.DelMsg(id); err != nil {
 		return err
 	}
-	g.cache.DelMsg(id)
 	for _, lbl := range gmailLabels {
-		g.cache.DelGmailLabel(lbl, id)
+		if err := b.cache.DelGmailLabel(lbl, id); err != nil {
+			return err
+		}
 	}
+	b.stale = append(b.stale, k)
 	return nil
 }
 
-func (g *Gmail) computeLabels(id string, added, removed []string) []string {
-	for _, lbl := range gmailLabels {
-		if lib.Contains(added, lbl) {
-			g.cache.SetGmailLabel(lbl, id)
-		} else if lib.Contains(removed, lbl) {
-			g.cache.DelGmailLabel(lbl, id)
-		}
-	}
-
-	if old, ok := g.cache.GetMsgLabels(id); ok {
+// computeLabels returns the labels of message id after the given changes.
+// The cache is left alone; writeLabels records them.
+func (g *Gmail) computeLabels(id string, added, removed []string) ([]string, error) {
+	if old, ok, err := g.cache.GetMsgLabels(id); err != nil {
+		return nil, err
+	} else if ok {
 		nlabels := make(map[string]struct{})
 		for _, l := range old {
 			nlabels[l] = struct{}{}
@@ -262,54 +475,113 @@ func (g *Gmail) computeLabels(id string, added, removed []string) []string {
 			labels[i] = l
 			i++
 		}
-		return labels
+		return labels, nil
 	}
 	// This shouldn't happen--there should always be a cache hit--but OK.
-	return added
+	return added, nil
 }
 
-func (g *Gmail) labelsChanged(id string, newLabels []string) bool {
-	if old, ok := g.cache.GetMsgLabels(id); ok {
-		sort.Strings(old)
-		sort.Strings(newLabels)
-		if old != nil && len(old) == len(newLabels) {
-			for i := 0; i < len(old); i++ {
-				if old[i] != newLabels[i] {
-					return true
-				}
-			}
+func (g *Gmail) labelsChanged(id string, newLabels []string) (bool, error) {
+	if old, ok, err := g.cache.GetMsgLabels(id); err != nil {
+		return false, err
+	} else if ok {
+		return !sameLabels(old, newLabels), nil
+	}
+	return true, nil
+}
+
+// sameLabels reports whether a and b hold the same labels, sorting both.
+func sameLabels(a, b []string) bool {
+	sort.Strings(a)
+	sort.Strings(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] {
 			return false
-		} else {
-			return true
 		}
 	}
 	return true
 }
 
-func (g *Gmail) writeLabels(id string, labels []string) error {
-	k, ok := g.cache.GetMsgKey(id)
-	if !ok {
+func (g *Gmail) writeLabels(b *batch, id string, labels []string) error {
+	k, ok, err := b.cache.GetMsgKey(id)
+	if err != nil {
+		return err
+	} else if !ok {
 		log.Println("unknown message", id, "for write labels")
 		// XXX: Seems the API gives us label changes for messages we've never seen before that don't current exist. Dunno why.
 		return nil //unknownMessage
 	}
-	msg, c, err := g.getMaildirMessage(k)
+	if err := setGmailLabels(b, id, labels); err != nil {
+		return err
+	}
+	fn, err := g.dir.GetFile(k)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
-	msg.Header[labelsHeader] = labels
-	kn, err := g.deliverMessage(msg)
+	date, err := msgDate(b.cache, id, fn)
+	if err != nil {
+		return err
+	}
+	d, err := g.dir.ForRewrite(fn)
+	var f io.ReadCloser
+	if err == nil {
+		f, err = g.dir.OpenFile(fn)
+	}
+	if err == maildir.ErrNoIdentity || err == maildir.ErrNoRecipient {
+		// Without the keys, the file keeps its old labels; the cache has the
+		// new ones.
+		return b.cache.SetMsgLabels(id, labels)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	kn, msg, sum, err := g.deliverStream(d, f, labels, []headerEdit{{labelsHeader, labels}}, date)
 	if err != nil {
 		return err
 	}
+	b.delivered = append(b.delivered, kn)
 	// Update the cache.
-	g.cache.SetMsgLabels(id, labels)
-	g.cache.SetMsgKey(id, kn)
-	// Delete the old message
-	if err := g.dir.Delete(k); err != nil {
+	if err := b.cache.SetMsgLabels(id, labels); err != nil {
 		return err
 	}
+	return g.replaceMsg(b, id, k, kn, msg, sum)
+}
+
+// msgDate returns the date to give a rewritten copy of message id, whose file
+// is fn: when Gmail received it, or, for messages cached before that was
+// recorded, the date of fn, which mail readers may have touched since.
+func msgDate(c *gmailCache, id, fn string) (time.Time, error) {
+	if t, ok, err := c.GetMsgDate(id); err != nil || ok {
+		return t, err
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// replaceMsg records that message id, whose file was k, was delivered again
+// as kn, with header msg and SHA-256 sum.
+func (g *Gmail) replaceMsg(b *batch, id string, k, kn maildir.Key, msg *mail.Message, sum string) error {
+	if err := b.cache.SetMsgKey(id, kn); err != nil {
+		return err
+	}
+	if err := g.setDigest(b, id, sum, 0); err != nil {
+		return err
+	}
+	if _, ok := getMessageId(msg); !ok {
+		// The synthesized Message-Id changes with the file's contents.
+		if mId, err := g.messageIdForKey(kn, msg); err != nil {
+			return err
+		} else if err := b.cache.SetIds(id, mId); err != nil {
+			return err
+		}
+	}
+	b.stale = append(b.stale, k)
 	return nil
 }
 
@@ -327,39 +599,62 @@ func (g *Gmail) labelToId(label string) (string, error) {
 }
 
 func (g *Gmail) handleNewMsg(id string) msgOp {
-	k, exists := g.cache.GetMsgKey(id)
 	o := msgOp{Id: id}
+	_, exists, err := g.cache.GetMsgKey(id)
+	if err != nil {
+		o.Error = err
+		return o
+	}
 	if !exists {
-		o.Operation = ADD
-		m, err := g.getBody(id)
-		if err != nil || m == nil {
-			if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
-				// XXX: 404 on a message add probably means it was deleted later. OK.
-			} else {
-				o.Error = err
-			}
-			o.Operation = NONE
+		if excluded, err := g.cache.IsExcluded(id); err != nil {
+			o.Error = err
+			return o
+		} else if excluded {
 			return o
 		}
-		o.Msg = m
 	}
 	if err := g.getMetaData(&o); err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == 404 && !exists {
+			// XXX: 404 on a message add probably means it was deleted later. OK.
+			return o
+		}
 		o.Error = err
 		return o
 	}
-	if g.labelsChanged(id, o.Labels) && exists {
-		// Have to fetch body.
-		m, c, err := g.getMaildirMessage(k)
-		if err != nil {
+	if !exists && SyncDrafts && lib.Contains(o.Labels, draftLabel) {
+		// SyncDrafts takes care of it.
+		return o
+	}
+	if !exists && !g.retainSince.IsZero() && internalTime(o.InternalDate).Before(g.retainSince) {
+		o.Operation = EXCLUDE
+		return o
+	}
+	if !exists {
+		o.Operation = ADD
+		if err := g.getBody(&o); err == badMessage {
+			log.Println("Error parsing message", id)
+			// XXX: Don't return an error here. These are often chats and such, due to bugs in the Gmail API.
+			o.Operation = NONE
+		} else if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+			// Deleted since we got its metadata.
+			o.Operation = NONE
+		} else if err != nil {
 			o.Error = err
-			return o
 		}
-		defer c.Close()
-		o.Msg = m
+		return o
+	}
+	changed, err := g.labelsChanged(id, o.Labels)
+	if err != nil {
+		o.Error = err
+		return o
+	}
+	if changed {
 		o.Operation = WRITE_LABELS
-		o.Msg.Header[labelsHeader] = o.Labels
-	} else if o.Operation == ADD {
-		o.Msg.Header[labelsHeader] = o.Labels
+	} else if _, ok, err := g.cache.GetThreadId(id); err != nil {
+		o.Error = err
+	} else if !ok && o.ThreadId != "" {
+		// Cached before threads were recorded.
+		o.Operation = SET_THREAD
 	}
 	return o
 }
@@ -382,6 +677,8 @@ func (g *Gmail) incremental(historyId uint64) error {
 		histEvents[i] = make(chan msgOp, MessageBufferSize)
 	}
 	ops := make(chan msgOp, MessageBufferSize)
+	// Closed if writing fails, to stop the producers.
+	done := make(chan struct{})
 
 	// Process new messages. This spins off ConcurrentDownloads goroutines that
 	// download message bodies and labels.
@@ -399,6 +696,9 @@ func (g *Gmail) incremental(historyId uint64) error {
 		go func() {
 			defer wg.Done()
 			for op := range histEvents[idx] {
+				if stopped(done) {
+					continue
+				}
 				if op.Operation == ADD {
 					ops <- g.handleNewMsg(op.Id)
 				} else {
@@ -414,8 +714,41 @@ func (g *Gmail) incremental(historyId uint64) error {
 
 	t := uint(0) // Total count, for progress reporting.
 	go func() {
-		for true {
-			r, err := g.svc.GetHistory(historyId, g.labelId, page)
+		defer func() {
+			for _, h := range histEvents {
+				close(h)
+			}
+		}()
+		added := make(map[string]struct{})
+		// add enqueues the download of message id, once.
+		add := func(id string, h uint64) {
+			if _, ok := added[id]; !ok {
+				added[id] = struct{}{}
+				histEvents[shardForMsgId(id)] <- msgOp{Id: id, Operation: ADD, HistoryId: h}
+			}
+		}
+		expanded := make(map[string]struct{})
+		// addThread enqueues the messages of thread th, which one of its
+		// messages just brought into the label, if none of them are cached.
+		addThread := func(th string, h uint64) error {
+			if _, ok := expanded[th]; ok || th == "" {
+				return nil
+			}
+			expanded[th] = struct{}{}
+			ids, err := g.newThreadMsgs(th)
+			for _, id := range ids {
+				add(id, h)
+			}
+			return err
+		}
+		for !stopped(done) {
+			label := g.labelId
+			if SyncThreads {
+				// Messages in the label's threads needn't have the label;
+				// wanted() picks them out.
+				label = ""
+			}
+			r, err := g.svc.GetHistory(historyId, label, page)
 			if e, ok := err.(*googleapi.Error); ok && e.Code == 404 && page == "" && historyId > 0 {
 				// Full sync required.
 				ops <- msgOp{Error: fullSyncRequired}
@@ -432,8 +765,19 @@ func (g *Gmail) incremental(historyId uint64) error {
 				}
 				// Enqueue adds.
 				for _, a := range m.MessagesAdded {
-					shard := shardForMsgId(a.Message.Id)
-					histEvents[shard] <- msgOp{Id: a.Message.Id, Operation: ADD, HistoryId: m.Id}
+					if ok, err := g.wanted(a.Message); err != nil {
+						ops <- msgOp{Error: err}
+						return
+					} else if !ok {
+						continue
+					}
+					add(a.Message.Id, m.Id)
+					if SyncThreads && g.labelId != "" && lib.Contains(a.Message.LabelIds, g.labelId) {
+						if err := addThread(a.Message.ThreadId, m.Id); err != nil {
+							ops <- msgOp{Error: err}
+							return
+						}
+					}
 				}
 				// Enqueue deletes.
 				for _, d := range m.MessagesDeleted {
@@ -446,7 +790,9 @@ func (g *Gmail) incremental(historyId uint64) error {
 					Removed []string
 				}
 				labels := make(map[string]lchange)
+				msgs := make(map[string]*gmail.Message)
 				for _, l := range m.LabelsAdded {
+					msgs[l.Message.Id] = l.Message
 					if ls, ok := labels[l.Message.Id]; ok {
 						labels[l.Message.Id] = lchange{
 							Added:   append(ls.Added, l.LabelIds...),
@@ -456,6 +802,7 @@ func (g *Gmail) incremental(historyId uint64) error {
 					}
 				}
 				for _, l := range m.LabelsRemoved {
+					msgs[l.Message.Id] = l.Message
 					if ls, ok := labels[l.Message.Id]; ok {
 						labels[l.Message.Id] = lchange{
 							Added:   ls.Added,
@@ -465,8 +812,46 @@ func (g *Gmail) incremental(historyId uint64) error {
 					}
 				}
 				for id, changes := range labels {
-					newLabels := g.computeLabels(id, changes.Added, changes.Removed)
-					if g.labelsChanged(id, newLabels) {
+					if SyncThreads && g.labelId != "" && lib.Contains(changes.Added, g.labelId) {
+						if err := addThread(msgs[id].ThreadId, m.Id); err != nil {
+							ops <- msgOp{Error: err}
+							return
+						}
+					}
+					if SyncThreads || SyncDrafts {
+						// Messages we don't have may have just become wanted:
+						// by joining one of the label's threads, or by being
+						// sent, if they were drafts left to SyncDrafts.
+						if _, ok, err := g.cache.GetMsgKey(id); err != nil {
+							ops <- msgOp{Error: err}
+							return
+						} else if !ok {
+							wanted := SyncDrafts && lib.Contains(changes.Removed, draftLabel)
+							if !wanted && SyncThreads {
+								if wanted, err = g.wanted(msgs[id]); err != nil {
+									ops <- msgOp{Error: err}
+									return
+								}
+							}
+							if wanted {
+								add(id, m.Id)
+								continue
+							} else if SyncThreads {
+								continue
+							}
+						}
+					}
+					newLabels, err := g.computeLabels(id, changes.Added, changes.Removed)
+					if err != nil {
+						ops <- msgOp{Error: err}
+						return
+					}
+					changed, err := g.labelsChanged(id, newLabels)
+					if err != nil {
+						ops <- msgOp{Error: err}
+						return
+					}
+					if changed {
 						shard := shardForMsgId(id)
 						histEvents[shard] <- msgOp{Id: id, Labels: newLabels, Operation: WRITE_LABELS, HistoryId: m.Id}
 					}
@@ -476,61 +861,260 @@ func (g *Gmail) incremental(historyId uint64) error {
 				break
 			}
 		}
-		for _, h := range histEvents {
-			close(h)
-		}
 	}()
-	i := uint(0)
-	for o := range ops {
-		// Update progress bar.
-		if g.progress != nil {
-			g.progress <- lib.Progress{Current: i, Total: t}
-		}
-		i++
-		if o.Error != nil {
-			return o.Error
-		}
-		if o.Operation == NONE {
-			continue
-		}
-		if err := g.writeOperation(o); err != nil {
-			return err
-		}
+	if _, err := g.writeOps(ops, &t); err != nil {
+		g.drainOps(ops, done)
+		return err
 	}
-	g.cache.SetHistoryIdx(historyId)
-	return nil
+	return g.cache.SetHistoryIdx(historyId)
 }
 
-func (g *Gmail) writeOperation(o msgOp) error {
+func (g *Gmail) writeOperation(b *batch, o msgOp) error {
 	switch o.Operation {
 	case ADD:
-		if err := g.writeAdd(o); err != nil {
+		if err := g.writeAdd(b, o); err != nil {
 			return err
 		}
 	case DELETE:
-		if err := g.writeDel(o.Id); err != nil {
+		if err := g.writeDel(b, o.Id); err != nil {
 			return err
 		}
 	case WRITE_LABELS:
-		if err := g.writeLabels(o.Id, o.Labels); err != nil {
+		if err := g.writeLabels(b, o.Id, o.Labels); err != nil {
+			return err
+		}
+	case MATCH:
+		if err := g.writeMatch(b, o); err != nil {
 			return err
 		}
+	case EXCLUDE:
+		return b.cache.SetExcluded(o.Id)
+	}
+	if o.ThreadId != "" && o.Operation != DELETE {
+		return g.recordThread(b, o.Id, o.ThreadId)
 	}
 	return nil
 }
 
+// recordThread records that message id is in thread tid, unless the cache
+// already says so.
+func (g *Gmail) recordThread(b *batch, id, tid string) error {
+	if t, ok, err := b.cache.GetThreadId(id); err != nil || (ok && t == tid) {
+		return err
+	}
+	return b.cache.SetThreadId(id, tid)
+}
+
+// wanted reports whether message m, as described by the history API, should
+// be synced: when syncing threads of a label, messages without the label are
+// wanted if their thread is.
+func (g *Gmail) wanted(m *gmail.Message) (bool, error) {
+	if g.labelId == "" || !SyncThreads || lib.Contains(m.LabelIds, g.labelId) {
+		return true, nil
+	}
+	if m.ThreadId == "" {
+		return false, nil
+	}
+	_, ok, err := g.cache.GetThreadMsgs(m.ThreadId)
+	return ok, err
+}
+
+// newThreadMsgs returns the messages of thread t if none of them are cached:
+// when a thread gains the label synced with SyncThreads, its older messages
+// are synced too, not only those added to it from then on.
+func (g *Gmail) newThreadMsgs(t string) ([]string, error) {
+	if _, ok, err := g.cache.GetThreadMsgs(t); err != nil || ok {
+		return nil, err
+	}
+	th, err := g.svc.GetThread(t)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, m := range th.Messages {
+		ids = append(ids, m.Id)
+	}
+	return ids, nil
+}
+
+// writeOps writes the operations received on ops until it is closed or an
+// operation fails, returning the highest history ID written. Operations that
+// are already queued are grouped into batches of up to CacheBatchSize, each
+// committed to the cache in a single transaction.
+func (g *Gmail) writeOps(ops <-chan msgOp, total *uint) (uint64, error) {
+	historyId := uint64(0)
+	i := uint(0) // For updating progress bar.
+	for o := range ops {
+		pending := []msgOp{o}
+		// Only take what's already queued: producers may need to write to the
+		// cache too, so we mustn't wait on them while holding a transaction.
+	queued:
+		for len(pending) < CacheBatchSize {
+			select {
+			case o, ok := <-ops:
+				if !ok {
+					break queued
+				}
+				pending = append(pending, o)
+			default:
+				break queued
+			}
+		}
+		var opErr error
+		written := 0 // Operations before the failed one.
+		if err := g.writeBatch(func(b *batch) error {
+			for j, o := range pending {
+				// Update progress bar.
+				if g.progress != nil {
+					g.progress <- lib.Progress{Current: i, Total: *total}
+				}
+				i++
+				if o.Error != nil {
+					// Keep what was written before the failure.
+					opErr, written = o.Error, j
+					return nil
+				}
+				if o.Operation == NONE {
+					continue
+				}
+				if o.HistoryId > historyId {
+					historyId = o.HistoryId
+				}
+				if err := g.writeOperation(b, o); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			g.discardDelivered(pending)
+			return historyId, err
+		} else if opErr != nil {
+			g.discardDelivered(pending[written:])
+			return historyId, opErr
+		}
+	}
+	return historyId, nil
+}
+
+// stopped reports whether done is closed.
+func stopped(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// drainOps stops the producers of ops after writeOps failed, by closing done,
+// and waits for them to close ops, discarding the messages they delivered
+// meanwhile. Producers skip their remaining work once done is closed.
+func (g *Gmail) drainOps(ops <-chan msgOp, done chan<- struct{}) {
+	close(done)
+	var rest []msgOp
+	for o := range ops {
+		rest = append(rest, o)
+	}
+	g.discardDelivered(rest)
+}
+
+// discardDelivered removes the messages delivered for ops that won't be
+// recorded in the cache, so that they aren't left behind as duplicates.
+func (g *Gmail) discardDelivered(ops []msgOp) {
+	for _, o := range ops {
+		if o.Operation == ADD && o.Key != "" {
+			if err := g.dir.Delete(o.Key); err != nil {
+				log.Println("Couldn't delete message", o.Key, ":", err)
+			}
+		}
+	}
+}
+
+// listMessages sends the ID of every message on the server to ids, then
+// closes it. The IDs are also added to seen, unless it is nil. Errors are
+// reported on ops. It stops early once done is closed.
+func (g *Gmail) listMessages(ids chan<- string, ops chan<- msgOp, seen map[string]struct{}, total *uint, done <-chan struct{}) {
+	defer close(ids)
+	if SyncThreads && g.labelId != "" {
+		g.listThreads(ids, ops, seen, total, done)
+		return
+	}
+	page := ""
+	for !stopped(done) {
+		r, err := g.svc.GetMessages(g.labelId, page)
+		if err != nil {
+			ops <- msgOp{Error: err}
+			return
+		}
+		page = r.NextPageToken
+		*total += uint(r.ResultSizeEstimate)
+		for _, m := range r.Messages {
+			ids <- m.Id
+			if seen != nil {
+				seen[m.Id] = struct{}{}
+			}
+		}
+		if page == "" {
+			break
+		}
+	}
+}
+
+// listThreads is listMessages for SyncThreads: it sends the ID of every
+// message in a thread with the label.
+func (g *Gmail) listThreads(ids chan<- string, ops chan<- msgOp, seen map[string]struct{}, total *uint, done <-chan struct{}) {
+	page := ""
+	for !stopped(done) {
+		r, err := g.svc.GetThreads(g.labelId, page)
+		if err != nil {
+			ops <- msgOp{Error: err}
+			return
+		}
+		page = r.NextPageToken
+		for _, th := range r.Threads {
+			t, err := g.svc.GetThread(th.Id)
+			if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+				continue
+			} else if err != nil {
+				ops <- msgOp{Error: err}
+				return
+			}
+			// Progress counts messages, not threads.
+			*total += uint(len(t.Messages))
+			for _, m := range t.Messages {
+				ids <- m.Id
+				if seen != nil {
+					seen[m.Id] = struct{}{}
+				}
+			}
+		}
+		if page == "" {
+			break
+		}
+	}
+}
+
 func (g *Gmail) full() error {
 	log.Println("Performing full sync.")
+	limit, err := g.listLabelLimit()
+	if err != nil {
+		return err
+	}
 	// XXX: -in:chats to skip chats that aren't MIME messages.
 	newMsgs := make(chan string, MessageBufferSize)
 	ops := make(chan msgOp, MessageBufferSize)
+	done := make(chan struct{})
 	wg := sync.WaitGroup{}
 	for i := 0; i < ConcurrentDownloads; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for id := range newMsgs {
-				ops <- g.handleNewMsg(id)
+				if !stopped(done) {
+					ops <- g.handleNewMsg(id)
+				}
 			}
 		}()
 	}
@@ -540,62 +1124,61 @@ func (g *Gmail) full() error {
 	}()
 	seen := make(map[string]struct{}) // Used to compute deletes.
 	t := uint(0)                      // Total count, for progress reporting.
-	go func() {
-		defer close(newMsgs)
-		page := ""
-		for true {
-			r, err := g.svc.GetMessages(g.labelId, page)
-			if err != nil {
-				ops <- msgOp{Error: err}
-				return
-			}
-			page = r.NextPageToken
-			t += uint(r.ResultSizeEstimate)
-			for _, m := range r.Messages {
-				newMsgs <- m.Id
-				seen[m.Id] = struct{}{}
-			}
-			if page == "" {
-				break
-			}
-		}
-	}()
-	historyId := uint64(0)
-	i := uint(0) // For updating progress bar.
-	for o := range ops {
-		// Update progress bar.
-		if g.progress != nil {
-			g.progress <- lib.Progress{Current: i, Total: t}
-		}
-		i++
-		if o.Error != nil {
-			return o.Error
-		}
-		if o.Operation == NONE {
-			continue
-		}
-		if o.HistoryId > historyId {
-			historyId = o.HistoryId
-		}
-		if err := g.writeOperation(o); err != nil {
-			return err
-		}
+	listed := newMsgs
+	if limit != nil {
+		listed = make(chan string, MessageBufferSize)
+		go g.filterLabelLimit(limit, listed, newMsgs, ops)
+	}
+	go g.listMessages(listed, ops, seen, &t, done)
+	historyId, err := g.writeOps(ops, &t)
+	if err != nil {
+		g.drainOps(ops, done)
+		return err
 	}
 	is := make(chan string)
-	g.cache.GetMsgs(is)
+	errs := g.cache.GetMsgs(is)
+	var dels []string
 	for i := range is {
 		if _, ok := seen[i]; !ok {
-			if err := g.writeDel(i); err != nil {
-				return err
+			dels = append(dels, i)
+		}
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	// Excluded messages deleted from Gmail.
+	is = make(chan string)
+	errs = g.cache.GetExcluded(is)
+	for i := range is {
+		if _, ok := seen[i]; !ok {
+			dels = append(dels, i)
+		}
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	for len(dels) > 0 {
+		n := CacheBatchSize
+		if n > len(dels) {
+			n = len(dels)
+		}
+		if err := g.writeBatch(func(b *batch) error {
+			for _, i := range dels[:n] {
+				if err := g.writeDel(b, i); err != nil {
+					return err
+				}
 			}
+			return nil
+		}); err != nil {
+			return err
 		}
+		dels = dels[n:]
 	}
-	g.cache.SetHistoryIdx(historyId)
-	return nil
+	return g.cache.SetHistoryIdx(historyId)
 }
 
-func (g *Gmail) Sync(full bool, progress chan<- lib.Progress) error {
-	g.progress = progress
+// resolveLabel looks up the ID of the label to sync, if any.
+func (g *Gmail) resolveLabel() error {
 	if g.label != "" {
 		if l, err := g.labelToId(g.label); err != nil {
 			return err
@@ -603,8 +1186,35 @@ func (g *Gmail) Sync(full bool, progress chan<- lib.Progress) error {
 			g.labelId = l
 		}
 	}
+	return nil
+}
+
+func (g *Gmail) Sync(full bool, progress chan<- lib.Progress) error {
+	g.progress = progress
+	if err := g.resolveLabel(); err != nil {
+		return err
+	}
+	if widened, err := g.updateRetention(); err != nil {
+		return err
+	} else if widened {
+		// Only a full sync finds the messages no longer excluded.
+		log.Println("Retention policy widened--performing full sync")
+		full = true
+	}
+	if err := g.sync(full); err != nil {
+		return err
+	}
+	return g.applyRetention()
+}
+
+// sync performs an incremental sync if possible, and a full one otherwise.
+func (g *Gmail) sync(full bool) error {
 	// Get the cached history index.
-	if hidx := g.cache.GetHistoryIdx(); hidx > 0 && !full {
+	hidx, err := g.cache.GetHistoryIdx()
+	if err != nil {
+		return err
+	}
+	if hidx > 0 && !full {
 		if err := g.incremental(hidx); err != nil {
 			if err == fullSyncRequired {
 				log.Println("History token expired--falling back to full sync")
@@ -617,23 +1227,70 @@ func (g *Gmail) Sync(full bool, progress chan<- lib.Progress) error {
 	return g.full()
 }
 
+// getMessageId returns the Message-Id of m. Like notmuch, we use the first
+// one if there are several.
 func getMessageId(m *mail.Message) (string, bool) {
 	mIds := m.Header["Message-Id"]
-	if len(mIds) != 1 {
-		log.Println("Expected message to contain exactly 1 Message-Id header, got", mIds, "for", m)
+	if len(mIds) == 0 {
 		return "", false
 	}
-	mId := strings.Trim(mIds[0], "<>")
+	mId := strings.Trim(strings.TrimSpace(mIds[0]), "<>")
 	if len(mId) == 0 {
-		log.Println("Couldn't parse a valid Mesage-Id", mIds)
 		return "", false
 	}
 	return mId, true
 }
 
+// messageIdForKey returns the Message-Id of m, the maildir message with key k.
+// For messages without one, it synthesizes the same ID as notmuch does from
+// the SHA-1 of the file, as stored: compressed or encrypted if it is.
+func (g *Gmail) messageIdForKey(k maildir.Key, m *mail.Message) (string, error) {
+	if mId, ok := getMessageId(m); ok {
+		return mId, nil
+	}
+	fn, err := g.dir.GetFile(k)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("notmuch-sha1-%x", h.Sum(nil)), nil
+}
+
+// hashFile returns the hash h of the maildir message with key k, decompressed
+// and decrypted.
+func (g *Gmail) hashFile(k maildir.Key, h hash.Hash) ([]byte, error) {
+	f, err := g.dir.Open(k)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sha256File returns the hex SHA-256 of the maildir message with key k, as
+// recorded in the cache to detect corruption.
+func (g *Gmail) sha256File(k maildir.Key) (string, error) {
+	sum, err := g.hashFile(k, sha256.New())
+	return hex.EncodeToString(sum), err
+}
+
 func (g *Gmail) getMessageIdForGmailId(gId string) (string, bool) {
-	key, ok := g.cache.GetMsgKey(gId)
-	if !ok {
+	key, ok, err := g.cache.GetMsgKey(gId)
+	if err != nil {
+		log.Println("Couldn't get maildir key for", gId, err.Error())
+		return "", false
+	} else if !ok {
 		log.Println("Couldn't get maildir key for", gId)
 		return "", false
 	}
@@ -646,7 +1303,101 @@ func (g *Gmail) getMessageIdForGmailId(gId string) (string, bool) {
 	return getMessageId(m)
 }
 
+// readHeader reads the header of the message in maildir file fn.
+func (g *Gmail) readHeader(fn string) (mail.Header, error) {
+	f, err := g.dir.OpenFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := mail.ReadMessage(f)
+	if err != nil {
+		return nil, err
+	}
+	return m.Header, nil
+}
+
+// gmailIdsForNotmuchMessage finds the Gmail messages that a notmuch message is
+// a copy of. notmuch merges the files with the same Message-Id, such as a
+// message sent to yourself and its copy in the inbox, so there may be several.
+func (g *Gmail) gmailIdsForNotmuchMessage(m *nm.Message) ([]string, error) {
+	var fns []string
+	fs := m.Filenames()
+	var fn string
+	for fs.Next(&fn) {
+		fns = append(fns, fn)
+	}
+	return g.gmailIdsForFiles(fns, m.ID())
+}
+
+// gmailIdsForFiles finds the Gmail messages that the maildir files fns, which
+// have Message-Id mId, are copies of. The X-GM-MSGID header written at
+// delivery identifies a file's message reliably; files delivered without one
+// are covered by the messages the cache records for mId.
+func (g *Gmail) gmailIdsForFiles(fns []string, mId string) ([]string, error) {
+	gIds, _, err := g.cache.GetGmailIdsForMessageId(mId)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range fns {
+		h, err := g.readHeader(fn)
+		if err != nil {
+			continue
+		}
+		if gId, ok := parseGmailIdHeader(h.Get(gmailIdHeader)); ok && !lib.Contains(gIds, gId) {
+			gIds = append(gIds, gId)
+		}
+	}
+	return gIds, nil
+}
+
+// findNotmuchMessage finds the notmuch message for a Gmail message by the file
+// name of its maildir copy, falling back to its Message-Id.
+func (g *Gmail) findNotmuchMessage(db *nm.DB, gId string) (*nm.Message, bool, error) {
+	k, ok, err := g.cache.GetMsgKey(gId)
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		if fn, err := g.dir.GetFile(k); err == nil {
+			if m, err := db.FindMessageByFilename(fn); err == nil {
+				return m, true, nil
+			}
+		}
+	}
+	mId, ok, err := g.cache.GetMessageIdForGmailId(gId)
+	if err != nil {
+		return nil, false, err
+	} else if !ok {
+		log.Println("Couldn't get message id for gmail id", gId)
+		return nil, false, nil
+	}
+	m, err := db.FindMessage(mId)
+	if err != nil {
+		log.Println("Notmuch couldn't find message", mId, "(", err.Error(), ")")
+		return nil, false, nil
+	}
+	return m, true, nil
+}
+
+// notmuchUnsupported returns why notmuch can't index the messages delivered
+// to the maildir, or "" if it can.
+func (g *Gmail) notmuchUnsupported() string {
+	if g.dir.Encrypts() {
+		return "notmuch can't read encrypted messages"
+	} else if g.dir.Compression() == maildir.Zstd {
+		return "notmuch can't read zstd-compressed messages"
+	}
+	return ""
+}
+
 func (g *Gmail) SyncNotmuch() error {
+	if reason := g.notmuchUnsupported(); reason != "" {
+		// Messages notmuch didn't index would look read, and be marked read
+		// in Gmail by write-back.
+		log.Println("Skipping notmuch sync:", reason)
+		return nil
+	}
 	log.Println("Running notmuch new")
 	if err := exec.Command("notmuch", "new").Run(); err != nil {
 		log.Println("Error running notmuch new:", err.Error())
@@ -660,9 +1411,9 @@ func (g *Gmail) SyncNotmuch() error {
 	}
 	defer notmuch.Close()
 
-	notmuchTagToMessageIds := make(map[string]map[string]struct{})
+	notmuchTagToGmailIds := make(map[string]map[string]struct{})
 	for _, tag := range notmuchTags {
-		notmuchTagToMessageIds[tag] = make(map[string]struct{})
+		notmuchTagToGmailIds[tag] = make(map[string]struct{})
 	}
 	log.Println("Scanning all messages for notmuch tags:", notmuchTags)
 	for _, tag := range notmuchTags {
@@ -672,48 +1423,59 @@ func (g *Gmail) SyncNotmuch() error {
 		}
 		var message *nm.Message
 		for messages.Next(&message) {
-			notmuchTagToMessageIds[tag][message.ID()] = struct{}{}
+			gIds, err := g.gmailIdsForNotmuchMessage(message)
+			if err != nil {
+				return err
+			} else if len(gIds) == 0 {
+				log.Println("Couldn't get gmail id for message id", message.ID())
+			}
+			for _, gId := range gIds {
+				notmuchTagToGmailIds[tag][gId] = struct{}{}
+			}
 		}
 	}
 
 	// messages with gmail sent label should get notmuch set tag
 	log.Println("Syncing gmail sent label to notmuch sent tag")
 	gmailIdSentChan := make(chan string)
-	g.cache.GmailIdsForLabel(sentLabel, gmailIdSentChan)
-	for gId := range gmailIdSentChan {
-		mId, ok := g.cache.GetMessageIdForGmailId(gId)
-		if !ok {
-			log.Println("Couldn't get message id for gmail id", gId)
-			continue
-		}
-		if _, ok := notmuchTagToMessageIds[sentTag][mId]; ok {
+	gIds, err := collectItems(gmailIdSentChan, g.cache.GmailIdsForLabel(sentLabel, gmailIdSentChan))
+	if err != nil {
+		return err
+	}
+	for _, gId := range gIds {
+		if _, ok := notmuchTagToGmailIds[sentTag][gId]; ok {
 			continue
 		}
-		message, err := notmuch.FindMessage(mId)
+		message, ok, err := g.findNotmuchMessage(notmuch, gId)
 		if err != nil {
-			log.Println("Notmuch couldn't find message", mId, "(", err.Error(), ")")
+			return err
+		} else if !ok {
 			continue
 		}
 		err = message.AddTag(sentTag)
 		if err != nil {
-			log.Println("Couldn't add sent tag to message with id", mId, "(", err.Error(), ")")
+			log.Println("Couldn't add sent tag to message with id", message.ID(), "(", err.Error(), ")")
 			continue
 		}
-		log.Println("Added sent tag to ", mId)
+		log.Println("Added sent tag to ", message.ID())
 	}
 
 	// messages without notmuch unreadTag should have gmail unreadLabel removed
 	log.Println("Syncing notmuch unread tag to gmail unread label")
 	var messagesToRemoveUnreadLabel []string
 	gmailIdUnreadChan := make(chan string)
-	g.cache.GmailIdsForLabel(unreadLabel, gmailIdUnreadChan)
-	for gId := range gmailIdUnreadChan {
-		mId, ok := g.cache.GetMessageIdForGmailId(gId)
-		if !ok {
-			log.Println("Couldn't get message id for gmail id", gId)
+	gIds, err = collectItems(gmailIdUnreadChan, g.cache.GmailIdsForLabel(unreadLabel, gmailIdUnreadChan))
+	if err != nil {
+		return err
+	}
+	for _, gId := range gIds {
+		if _, ok := notmuchTagToGmailIds[unreadTag][gId]; ok {
 			continue
 		}
-		if _, ok := notmuchTagToMessageIds[unreadTag][mId]; ok {
+		// Messages notmuch hasn't indexed have no tags, but haven't been read.
+		if _, ok, err := g.findNotmuchMessage(notmuch, gId); err != nil {
+			return err
+		} else if !ok {
 			continue
 		}
 		messagesToRemoveUnreadLabel = append(messagesToRemoveUnreadLabel, gId)
@@ -722,18 +1484,20 @@ func (g *Gmail) SyncNotmuch() error {
 	// message with notmuch flaggedTag should have gmail flaggedLabel added
 	log.Println("Syncing notmuch flagged tag to gmail flagged label")
 	var messagesToAddFlaggedLabel []string
-	for mId := range notmuchTagToMessageIds[flaggedTag] {
-		gId, ok := g.cache.GetGmailIdForMessageId(mId)
-		if !ok {
-			log.Println("Couldn't get gmail id for message id", mId)
-			continue
-		}
-		if g.cache.HasGmailLabel(flaggedLabel, gId) {
+	for gId := range notmuchTagToGmailIds[flaggedTag] {
+		if has, err := g.cache.HasGmailLabel(flaggedLabel, gId); err != nil {
+			return err
+		} else if has {
 			continue
 		}
 		messagesToAddFlaggedLabel = append(messagesToAddFlaggedLabel, gId)
 	}
 
+	if g.features&WriteBack == 0 {
+		log.Println("Write-back disabled, not updating Gmail labels")
+		return nil
+	}
+
 	if len(messagesToRemoveUnreadLabel) > 0 {
 		// TODO: gmail api limits to 1000 message ids per call
 		if err := g.svc.ModifyLabels(messagesToRemoveUnreadLabel, []string{}, []string{unreadLabel}); err != nil {
@@ -1,17 +1,28 @@
 package gmail
 
 import (
+	"bufio"
+	"bytes"
+	"database/sql"
 	"encoding/base64"
 	"errors"
+	"filippo.io/age"
+	"fmt"
 	"github.com/meelapshah/outtake/lib"
 	"github.com/meelapshah/outtake/lib/maildir"
 	gmail "google.golang.org/api/gmail/v1"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
 	"os"
 	"path"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func newTestCache() gmailCache {
@@ -30,30 +41,314 @@ func newTestCache() gmailCache {
 func TestComputeLabels(t *testing.T) {
 	g := Gmail{cache: newTestCache()}
 	g.cache.SetMsgLabels("id", []string{"a", "b"})
-	ls := g.computeLabels("id", []string{"c"}, []string{"b"})
+	ls, err := g.computeLabels("id", []string{"c"}, []string{"b"})
+	if err != nil {
+		t.Fatalf(`computeLabels("id", {"c"}, {"b"}) = %v, expected no error`, err)
+	}
 	sort.Strings(ls)
 	if len(ls) != 2 || ls[0] != "a" || ls[1] != "c" {
 		t.Errorf(`computeLabels("id", {"c"}, {"b"}) = %v, expected {"a", "c"}`, ls)
 	}
+	if _, err := g.computeLabels("id", []string{unreadLabel}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The label index is only updated when the labels are written.
+	if ok, err := g.cache.HasGmailLabel(unreadLabel, "id"); err != nil || ok {
+		t.Errorf(`HasGmailLabel(UNREAD, "id") = %v, %v, expected false`, ok, err)
+	}
 }
 
 func TestLabelsChanged(t *testing.T) {
 	g := Gmail{cache: newTestCache()}
 	g.cache.SetMsgLabels("id", []string{"a", "b"})
-	if !g.labelsChanged("id", []string{"a"}) {
+	if c, err := g.labelsChanged("id", []string{"a"}); err != nil || !c {
 		t.Error(`labelsChanged("id", {"a"}) = false, expected true`)
 	}
-	if g.labelsChanged("id", []string{"a", "b"}) {
+	if c, err := g.labelsChanged("id", []string{"a", "b"}); err != nil || c {
 		t.Error(`labelsChanged("id", {"a", "b"}) = true, expected false`)
 	}
-	if !g.labelsChanged("id", []string{}) {
+	if c, err := g.labelsChanged("id", []string{}); err != nil || !c {
 		t.Error(`labelsChanged("id", {}) = false, expected true`)
 	}
-	if !g.labelsChanged("id", []string{"a", "b", "c"}) {
+	if c, err := g.labelsChanged("id", []string{"a", "b", "c"}); err != nil || !c {
 		t.Error(`labelsChanged("id", {"a", "b", "c"}) = false, expected true`)
 	}
 }
 
+func TestFeatureScopes(t *testing.T) {
+	for _, c := range []struct {
+		f      Features
+		scopes []string
+	}{
+		{0, []string{gmail.GmailReadonlyScope}},
+		{Send, []string{gmail.GmailReadonlyScope, gmail.GmailSendScope}},
+		{Drafts | Send, []string{gmail.GmailReadonlyScope, gmail.GmailComposeScope}},
+		{WriteBack | Send, []string{gmail.GmailModifyScope}},
+		{WriteBack | PermanentDelete, []string{gmail.MailGoogleComScope}},
+	} {
+		if ss := c.f.Scopes(); strings.Join(ss, " ") != strings.Join(c.scopes, " ") {
+			t.Errorf(`Features(%v).Scopes() = %v, expected %v`, c.f, ss, c.scopes)
+		}
+	}
+	if !scopesCover([]string{gmail.MailGoogleComScope}, WriteBack.Scopes()) {
+		t.Error(`scopesCover(full, modify) = false, expected true`)
+	}
+	if scopesCover([]string{gmail.GmailReadonlyScope}, WriteBack.Scopes()) {
+		t.Error(`scopesCover(readonly, modify) = true, expected false`)
+	}
+}
+
+func TestMigrateCache(t *testing.T) {
+	c := newTestCache()
+	c.SetHistoryIdx(1)
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	if err := migrateCache(&c, path.Join(d, "test_outtake_cache")); err != nil {
+		t.Fatalf(`migrateCache() = %v, expected nil`, err)
+	}
+	if v, ok, err := c.GetSchemaVersion(); err != nil || !ok || v != schemaVersion {
+		t.Errorf(`GetSchemaVersion() = %v, %v, %v, expected %v`, v, ok, err, schemaVersion)
+	}
+	c.SetSchemaVersion(schemaVersion + 1)
+	if err := migrateCache(&c, ""); err == nil {
+		t.Error(`migrateCache() of a newer cache = nil, expected error`)
+	}
+}
+
+func TestMigrateGmailIds(t *testing.T) {
+	c := newTestCache()
+	c.SetSchemaVersion(1)
+	// Version 1 kept a single Gmail ID per Message-Id, losing b's.
+	c.Cache.Set(midToGid, "mid@example.com", []byte("a"))
+	c.Cache.Set(gidToMid, "a", []byte("mid@example.com"))
+	c.Cache.Set(gidToMid, "b", []byte("mid@example.com"))
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	if err := migrateCache(&c, path.Join(d, "test_outtake_cache")); err != nil {
+		t.Fatalf(`migrateCache() = %v, expected nil`, err)
+	}
+	if gIds, ok, err := c.GetGmailIdsForMessageId("mid@example.com"); err != nil || !ok || !sameLabels(gIds, []string{"a", "b"}) {
+		t.Errorf(`GetGmailIdsForMessageId() = %v, %v, %v, expected [a b]`, gIds, ok, err)
+	}
+}
+
+func TestDumpLoadCache(t *testing.T) {
+	src, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	c, err := openGmailCache(src)
+	if err != nil {
+		panic(err)
+	}
+	c.SetMsgKey("a", "key-a")
+	c.SetMsgLabels("a", []string{"foo", "bar"})
+	c.SetIds("a", "mid@example.com")
+	c.SetGmailLabel(unreadLabel, "a")
+	c.SetHistoryIdx(42)
+	c.Cache.Close()
+
+	dump := new(strings.Builder)
+	if err := DumpCache(src, dump, false); err != nil {
+		t.Fatalf(`DumpCache() = %v, expected nil`, err)
+	}
+	dst, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	if err := LoadCache(dst, strings.NewReader(dump.String())); err != nil {
+		t.Fatalf(`LoadCache() = %v, expected nil`, err)
+	}
+	if err := LoadCache(dst, strings.NewReader(dump.String())); err == nil {
+		t.Error(`LoadCache() into a non-empty cache = nil, expected error`)
+	}
+	c, err = openGmailCache(dst)
+	if err != nil {
+		panic(err)
+	}
+	defer c.Cache.Close()
+	if k, ok, err := c.GetMsgKey("a"); err != nil || !ok || k != "key-a" {
+		t.Errorf(`GetMsgKey("a") = %v, %v, %v, expected "key-a"`, k, ok, err)
+	}
+	if ls, ok, err := c.GetMsgLabels("a"); err != nil || !ok || !sameLabels(ls, []string{"foo", "bar"}) {
+		t.Errorf(`GetMsgLabels("a") = %v, %v, %v, expected [foo bar]`, ls, ok, err)
+	}
+	if gIds, ok, err := c.GetGmailIdsForMessageId("mid@example.com"); err != nil || !ok || len(gIds) != 1 || gIds[0] != "a" {
+		t.Errorf(`GetGmailIdsForMessageId() = %v, %v, %v, expected [a]`, gIds, ok, err)
+	}
+	if ok, err := c.HasGmailLabel(unreadLabel, "a"); err != nil || !ok {
+		t.Errorf(`HasGmailLabel(UNREAD, "a") = %v, %v, expected true`, ok, err)
+	}
+	if h, err := c.GetHistoryIdx(); err != nil || h != 42 {
+		t.Errorf(`GetHistoryIdx() = %v, %v, expected 42`, h, err)
+	}
+}
+
+// fillTestCache records a message in every message namespace of c.
+func fillTestCache(c *gmailCache) {
+	c.SetMsgKey("a", "key-a")
+	c.SetMsgLabels("a", []string{"foo", "bar"})
+	c.SetIds("a", "mid@example.com")
+	c.SetIds("b", "mid@example.com")
+	c.SetMsgSize("a", 1234)
+	c.SetMsgSha256("a", "abcd")
+	c.SetThreadId("a", "t1")
+	c.SetMsgDate("a", 1500000000000)
+	c.SetGmailLabel(unreadLabel, "a")
+	c.SetHistoryIdx(42)
+}
+
+// checkTestCache checks that c has what fillTestCache recorded.
+func checkTestCache(t *testing.T, c *gmailCache) {
+	if k, ok, err := c.GetMsgKey("a"); err != nil || !ok || k != "key-a" {
+		t.Errorf(`GetMsgKey("a") = %v, %v, %v, expected "key-a"`, k, ok, err)
+	}
+	if ls, ok, err := c.GetMsgLabels("a"); err != nil || !ok || !sameLabels(ls, []string{"foo", "bar"}) {
+		t.Errorf(`GetMsgLabels("a") = %v, %v, %v, expected [foo bar]`, ls, ok, err)
+	}
+	if gIds, ok, err := c.GetGmailIdsForMessageId("mid@example.com"); err != nil || !ok || !sameLabels(gIds, []string{"a", "b"}) {
+		t.Errorf(`GetGmailIdsForMessageId() = %v, %v, %v, expected [a b]`, gIds, ok, err)
+	}
+	if d, ok, err := c.GetMsgDigest("a"); err != nil || !ok || d.Size != 1234 || d.Sha256 != "abcd" {
+		t.Errorf(`GetMsgDigest("a") = %v, %v, %v, expected 1234 bytes with SHA-256 abcd`, d, ok, err)
+	}
+	if th, ok, err := c.GetThreadId("a"); err != nil || !ok || th != "t1" {
+		t.Errorf(`GetThreadId("a") = %v, %v, %v, expected t1`, th, ok, err)
+	}
+	if d, ok, err := c.GetMsgDate("a"); err != nil || !ok || d.Unix() != 1500000000 {
+		t.Errorf(`GetMsgDate("a") = %v, %v, %v, expected 2017-07-14`, d, ok, err)
+	}
+	if ok, err := c.HasGmailLabel(unreadLabel, "a"); err != nil || !ok {
+		t.Errorf(`HasGmailLabel(UNREAD, "a") = %v, %v, expected true`, ok, err)
+	}
+	if h, err := c.GetHistoryIdx(); err != nil || h != 42 {
+		t.Errorf(`GetHistoryIdx() = %v, %v, expected 42`, h, err)
+	}
+}
+
+func TestSQLiteCache(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	s, err := newSQLiteCache(path.Join(d, "test_cache.sqlite"))
+	if err != nil {
+		t.Fatalf(`newSQLiteCache() = %v, expected nil`, err)
+	}
+	defer s.Close()
+	c := &gmailCache{s}
+	fillTestCache(c)
+	checkTestCache(t, c)
+	nss, err := s.Namespaces()
+	if err != nil {
+		t.Fatalf(`Namespaces() = %v, expected nil`, err)
+	}
+	for _, ns := range []string{midToKey, gidToMid, midToLabels, midToSize, midToSha256, midToThread, threadToMids, midToGid, labelToGidPrefix + unreadLabel, historyIndex} {
+		if !lib.Contains(nss, ns) {
+			t.Errorf(`Namespaces() = %v, expected it to contain %v`, nss, ns)
+		}
+	}
+	ks := make(chan string)
+	if ids, err := collectItems(ks, s.Items(midToGid, ks)); err != nil || len(ids) != 1 || ids[0] != "mid@example.com" {
+		t.Errorf(`Items(midToGid) = %v, %v, expected [mid@example.com]`, ids, err)
+	}
+	if err := s.Del(midToKey, "a"); err != nil {
+		t.Fatalf(`Del(midToKey, "a") = %v, expected nil`, err)
+	}
+	if _, ok, err := c.GetMsgKey("a"); err != nil || ok {
+		t.Errorf(`GetMsgKey("a") after Del = %v, %v, expected nothing`, ok, err)
+	}
+	if ls, ok, err := c.GetMsgLabels("a"); err != nil || !ok || len(ls) != 2 {
+		t.Errorf(`GetMsgLabels("a") after deleting its key = %v, %v, %v, expected [foo bar]`, ls, ok, err)
+	}
+	ks = make(chan string)
+	if ids, err := collectItems(ks, s.Items(midToKey, ks)); err != nil || len(ids) != 0 {
+		t.Errorf(`Items(midToKey) after Del = %v, %v, expected none`, ids, err)
+	}
+	if err := c.Batch(func(tc *gmailCache) error {
+		tc.SetMsgKey("c", "key-c")
+		return errors.New("failed")
+	}); err == nil {
+		t.Error(`Batch() of a failing function = nil, expected error`)
+	}
+	if _, ok, err := c.GetMsgKey("c"); err != nil || ok {
+		t.Errorf(`GetMsgKey("c") after a failed batch = %v, %v, expected nothing`, ok, err)
+	}
+}
+
+func TestSQLiteSchemaUpgrade(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	f := path.Join(d, "test_cache.sqlite")
+	// The messages table as version 2 created it.
+	db, err := sql.Open("sqlite", "file:"+f)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE messages (gmail_id TEXT PRIMARY KEY, maildir_key TEXT, message_id TEXT, labels TEXT)`); err != nil {
+		panic(err)
+	}
+	db.Close()
+	s, err := newSQLiteCache(f)
+	if err != nil {
+		t.Fatalf(`newSQLiteCache() = %v, expected nil`, err)
+	}
+	defer s.Close()
+	c := &gmailCache{s}
+	c.SetSchemaVersion(2)
+	c.SetMsgKey("a", "key-a")
+	if err := migrateCache(c, f); err != nil {
+		t.Fatalf(`migrateCache() = %v, expected nil`, err)
+	}
+	fillTestCache(c)
+	checkTestCache(t, c)
+}
+
+func TestMigrateCacheBackends(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	c, err := openGmailCache(d)
+	if err != nil {
+		panic(err)
+	}
+	fillTestCache(c)
+	c.Cache.Close()
+	if err := MigrateCache(d, BoltBackend, SQLiteBackend); err != nil {
+		t.Fatalf(`MigrateCache(bolt, sqlite) = %v, expected nil`, err)
+	}
+	if err := MigrateCache(d, BoltBackend, SQLiteBackend); err == nil {
+		t.Error(`MigrateCache(bolt, sqlite) over an existing cache = nil, expected error`)
+	}
+	bolt, _ := cachePath(d, BoltBackend)
+	os.Remove(bolt)
+	if err := MigrateCache(d, SQLiteBackend, BoltBackend); err != nil {
+		t.Fatalf(`MigrateCache(sqlite, bolt) = %v, expected nil`, err)
+	}
+	if c, err = openGmailCache(d); err != nil {
+		t.Fatalf(`openGmailCache() = %v, expected nil`, err)
+	}
+	defer c.Cache.Close()
+	checkTestCache(t, c)
+}
+
+func TestGmailIdHeader(t *testing.T) {
+	h := formatGmailIdHeader("16c5d4e3f2a1b0c9")
+	if h != "1640951714739761353" {
+		t.Errorf(`formatGmailIdHeader("16c5d4e3f2a1b0c9") = %v, expected 1640951714739761353`, h)
+	}
+	if id, ok := parseGmailIdHeader(h); !ok || id != "16c5d4e3f2a1b0c9" {
+		t.Errorf(`parseGmailIdHeader(%v) = %v, %v, expected 16c5d4e3f2a1b0c9, true`, h, id, ok)
+	}
+}
+
 type testService struct {
 	gmailService
 	Msgs     map[string]string
@@ -61,13 +356,31 @@ type testService struct {
 	Labels   *gmail.ListLabelsResponse
 	History  map[string]*gmail.ListHistoryResponse
 	Messages map[string]*gmail.ListMessagesResponse
+	Threads  map[string]*gmail.ListThreadsResponse
+	Thread   map[string]*gmail.Thread
+	// LabelMessages lists the messages of each label, in one page.
+	LabelMessages map[string]*gmail.ListMessagesResponse
+	// Drafts maps draft IDs to their message IDs; Uploaded records the raw
+	// drafts sent to Gmail.
+	Drafts   map[string]string
+	Uploaded [][]byte
+	// Full holds messages as returned by GetFull, and Attachments the bodies
+	// of their parts.
+	Full        map[string]*gmail.Message
+	Attachments map[string][]byte
+	// Fetched records the IDs of the messages downloaded.
+	mu      sync.Mutex
+	Fetched []string
 }
 
-func (s *testService) GetRawMessage(id string) (string, error) {
+func (s *testService) GetRawMessage(id string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	s.Fetched = append(s.Fetched, id)
+	s.mu.Unlock()
 	if m, ok := s.Msgs[id]; ok {
-		return m, nil
+		return ioutil.NopCloser(base64.NewDecoder(base64.URLEncoding, strings.NewReader(m))), nil
 	}
-	return "", errors.New("not found")
+	return nil, errors.New("not found")
 }
 
 func (s *testService) GetMetadata(id string) (*gmail.Message, error) {
@@ -77,6 +390,20 @@ func (s *testService) GetMetadata(id string) (*gmail.Message, error) {
 	return nil, errors.New("not found")
 }
 
+func (s *testService) GetFull(id string) (*gmail.Message, error) {
+	if m, ok := s.Full[id]; ok {
+		return m, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *testService) GetAttachment(msgId, id string) ([]byte, error) {
+	if a, ok := s.Attachments[id]; ok {
+		return a, nil
+	}
+	return nil, errors.New("not found")
+}
+
 func (s *testService) GetLabels() (*gmail.ListLabelsResponse, error) {
 	return s.Labels, nil
 }
@@ -89,12 +416,52 @@ func (s *testService) GetHistory(i uint64, label, page string) (*gmail.ListHisto
 }
 
 func (s *testService) GetMessages(q, page string) (*gmail.ListMessagesResponse, error) {
+	if q != "" {
+		if m, ok := s.LabelMessages[q]; ok {
+			return m, nil
+		}
+		return &gmail.ListMessagesResponse{}, nil
+	}
 	if m, ok := s.Messages[page]; ok {
 		return m, nil
 	}
 	return nil, errors.New("not found")
 }
 
+func (s *testService) GetThreads(label, page string) (*gmail.ListThreadsResponse, error) {
+	if m, ok := s.Threads[page]; ok {
+		return m, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *testService) GetThread(id string) (*gmail.Thread, error) {
+	if m, ok := s.Thread[id]; ok {
+		return m, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *testService) GetDrafts(page string) (*gmail.ListDraftsResponse, error) {
+	r := &gmail.ListDraftsResponse{}
+	for id, m := range s.Drafts {
+		r.Drafts = append(r.Drafts, &gmail.Draft{Id: id, Message: &gmail.Message{Id: m}})
+	}
+	return r, nil
+}
+
+func (s *testService) CreateDraft(raw []byte) (*gmail.Draft, error) {
+	return s.UpdateDraft(fmt.Sprintf("d%d", len(s.Drafts)+1), raw)
+}
+
+func (s *testService) UpdateDraft(id string, raw []byte) (*gmail.Draft, error) {
+	s.Uploaded = append(s.Uploaded, raw)
+	m := fmt.Sprintf("m%d", len(s.Uploaded))
+	s.Msgs[m] = base64.URLEncoding.EncodeToString(raw)
+	s.Drafts[id] = m
+	return &gmail.Draft{Id: id, Message: &gmail.Message{Id: m}}, nil
+}
+
 func getTestClient() (*Gmail, *testService, string) {
 	d, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -109,19 +476,56 @@ func getTestClient() (*Gmail, *testService, string) {
 		panic(err)
 	}
 	s := &testService{
-		Msgs:     make(map[string]string),
-		Metadata: make(map[string]*gmail.Message),
-		Messages: make(map[string]*gmail.ListMessagesResponse),
-		History:  make(map[string]*gmail.ListHistoryResponse),
+		Msgs:          make(map[string]string),
+		Metadata:      make(map[string]*gmail.Message),
+		Messages:      make(map[string]*gmail.ListMessagesResponse),
+		LabelMessages: make(map[string]*gmail.ListMessagesResponse),
+		History:       make(map[string]*gmail.ListHistoryResponse),
+		Threads:       make(map[string]*gmail.ListThreadsResponse),
+		Thread:        make(map[string]*gmail.Thread),
+		Drafts:        make(map[string]string),
+		Full:          make(map[string]*gmail.Message),
+		Attachments:   make(map[string][]byte),
 	}
 	g := &Gmail{
-		dir:   md,
-		cache: gmailCache{c},
-		svc:   s,
+		dir:    md,
+		cache:  gmailCache{c},
+		svc:    s,
+		budget: lib.NewByteBudget(MemoryBudget),
 	}
 	return g, s, d
 }
 
+func TestGmailIdsForFiles(t *testing.T) {
+	c, _, _ := getTestClient()
+	// A message sent to yourself: a and b share a Message-Id, and the copy of
+	// c, delivered with its Gmail ID, has it too.
+	c.cache.SetIds("a", "mid@example.com")
+	c.cache.SetIds("b", "mid@example.com")
+	k, err := c.dir.DeliverRaw(strings.NewReader("Message-Id: <mid@example.com>\r\n\r\nbody\r\n"), "S")
+	if err != nil {
+		panic(err)
+	}
+	kc, err := c.dir.DeliverRaw(strings.NewReader("Message-Id: <mid@example.com>\r\n"+gmailIdHeader+": "+formatGmailIdHeader("16c5d4e3f2a1b0c9")+"\r\n\r\nbody\r\n"), "S")
+	if err != nil {
+		panic(err)
+	}
+	var fns []string
+	for _, k := range []maildir.Key{k, kc} {
+		fn, err := c.dir.GetFile(k)
+		if err != nil {
+			panic(err)
+		}
+		fns = append(fns, fn)
+	}
+	if gIds, err := c.gmailIdsForFiles(fns, "mid@example.com"); err != nil || !sameLabels(gIds, []string{"a", "b", "16c5d4e3f2a1b0c9"}) {
+		t.Errorf(`gmailIdsForFiles() = %v, %v, expected [a b 16c5d4e3f2a1b0c9]`, gIds, err)
+	}
+	if gIds, err := c.gmailIdsForFiles(fns[:1], "other@example.com"); err != nil || len(gIds) != 0 {
+		t.Errorf(`gmailIdsForFiles() of an unknown message = %v, %v, expected none`, gIds, err)
+	}
+}
+
 func TestSync(t *testing.T) {
 	c, svc, dir := getTestClient()
 	m := base64.URLEncoding.EncodeToString([]byte(
@@ -154,11 +558,11 @@ asdf`))
 	if len(fs) != 3 {
 		t.Errorf(`Sync(true, nil) wrote %v messages, expected 3`, len(fs))
 	}
-	if i := c.cache.GetHistoryIdx(); i != 3 {
+	if i, err := c.cache.GetHistoryIdx(); err != nil || i != 3 {
 		t.Errorf(`GetHistoryIdx() == %v, expected 3`, i)
 	}
 	// And one of the messages should have LABEL_3 set.
-	k, ok := c.cache.GetMsgKey("0x3")
+	k, ok, err := c.cache.GetMsgKey("0x3")
 	if !ok {
 		t.Errorf(`GetMsgKey("0x3") == false, expected true`)
 	}
@@ -216,7 +620,7 @@ asdf`))
 		t.Errorf(`Sync(true, nil) wrote %v messages to "cur", expected 0`, len(fs))
 	}
 	// And 0x3 should no longer have LABEL_3 set.
-	k, ok = c.cache.GetMsgKey("0x3")
+	k, ok, err = c.cache.GetMsgKey("0x3")
 	if !ok {
 		t.Errorf(`GetMsgKey("0x3") == false, expected true`)
 	}
@@ -233,7 +637,7 @@ asdf`))
 		t.Errorf(`Expected %v to not contain X-Keywords: LABEL_3`, string(bs))
 	}
 	// And 0x2 should have LABEL_2 set.
-	k, ok = c.cache.GetMsgKey("0x2")
+	k, ok, err = c.cache.GetMsgKey("0x2")
 	if !ok {
 		t.Errorf(`GetMsgKey("0x2") == false, expected true`)
 	}
@@ -250,3 +654,901 @@ asdf`))
 		t.Errorf(`Expected %v to contain X-Keywords: LABEL_2`, string(bs))
 	}
 }
+
+func TestSyncFailure(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	c.cache.SetHistoryIdx(1)
+	var added []*gmail.HistoryMessageAdded
+	for i := 0; i < 2*MessageBufferSize; i++ {
+		id := fmt.Sprintf("%x", i+1)
+		svc.Msgs[id] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody\r\n"))
+		svc.Metadata[id] = &gmail.Message{Id: id, HistoryId: 2}
+		added = append(added, &gmail.HistoryMessageAdded{Message: &gmail.Message{Id: id}})
+	}
+	// The next page of history fails, with downloads still queued.
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History:       []*gmail.History{{Id: 2, MessagesAdded: added}},
+		NextPageToken: "gone",
+	}
+	if err := c.Sync(false, nil); err == nil {
+		t.Fatal(`Sync(false, nil) with a failing history page = nil, expected error`)
+	}
+	// Producers left running would go on delivering.
+	time.Sleep(100 * time.Millisecond)
+	is := make(chan string)
+	ids, err := collectItems(is, c.cache.GetMsgs(is))
+	if err != nil {
+		panic(err)
+	}
+	files := 0
+	if err := c.dir.Walk(func(maildir.Message) error {
+		files++
+		return nil
+	}); err != nil {
+		panic(err)
+	}
+	if files != len(ids) {
+		t.Errorf(`Sync(false, nil) left %d files for %d cached messages, expected no strays`, files, len(ids))
+	}
+}
+
+func TestWriteOpsRollback(t *testing.T) {
+	c, _, _ := getTestClient()
+	deliver := func(body string) maildir.Key {
+		k, err := c.dir.DeliverRaw(strings.NewReader(body), "S")
+		if err != nil {
+			panic(err)
+		}
+		return k
+	}
+	kOld := deliver("Message-Id: <old@x>\r\n\r\nold\r\n")
+	kL := deliver("Message-Id: <l@x>\r\n\r\nl\r\n")
+	if err := c.writeBatch(func(b *batch) error {
+		if err := c.writeAdd(b, msgOp{Id: "l", Key: kL, Msg: &mail.Message{Header: mail.Header{"Message-Id": {"<l@x>"}}}}); err != nil {
+			return err
+		}
+		return c.writeAdd(b, msgOp{Id: "old", Key: kOld, Msg: &mail.Message{Header: mail.Header{"Message-Id": {"<old@x>"}}}})
+	}); err != nil {
+		panic(err)
+	}
+	kA := deliver("Message-Id: <a@x>\r\n\r\na\r\n")
+	kB := deliver("\r\nb\r\n")
+	// Without a Message-Id, b's file is hashed, which fails once it's gone.
+	fnB, _ := c.dir.GetFile(kB)
+	if err := os.Remove(fnB); err != nil {
+		panic(err)
+	}
+
+	ops := make(chan msgOp, 4)
+	ops <- msgOp{Id: "old", Operation: DELETE}
+	ops <- msgOp{Id: "l", Labels: []string{"INBOX"}, Operation: WRITE_LABELS}
+	ops <- msgOp{Id: "a", Key: kA, Msg: &mail.Message{Header: mail.Header{"Message-Id": {"<a@x>"}}}, Operation: ADD}
+	ops <- msgOp{Id: "b", Key: kB, Msg: &mail.Message{Header: mail.Header{}}, Operation: ADD}
+	close(ops)
+	total := uint(4)
+	if _, err := c.writeOps(ops, &total); err == nil {
+		t.Fatal(`writeOps() with a failing ADD = nil, expected error`)
+	}
+
+	if _, ok, err := c.cache.GetMsgKey("a"); err != nil || ok {
+		t.Errorf(`GetMsgKey("a") = %v, %v, expected the failed batch rolled back`, ok, err)
+	}
+	if _, err := c.dir.GetFile(kA); err == nil {
+		t.Errorf(`writeOps() kept the file delivered for the failed batch`)
+	}
+	if k, ok, err := c.cache.GetMsgKey("old"); err != nil || !ok || k != kOld {
+		t.Errorf(`GetMsgKey("old") = %v, %v, %v, expected %v kept by the rollback`, k, ok, err, kOld)
+	}
+	if _, err := c.dir.GetFile(kOld); err != nil {
+		t.Errorf(`writeOps() removed the file of a deletion that was rolled back: %v`, err)
+	}
+	// The copy rewritten with l's new labels is gone; l's file is kept.
+	if ks, err := c.dir.Keys(); err != nil || len(ks) != 2 {
+		t.Errorf(`Keys() = %v, %v after the rollback, expected only old and l`, ks, err)
+	}
+	if k, _, _ := c.cache.GetMsgKey("l"); k != kL {
+		t.Errorf(`GetMsgKey("l") = %v, expected %v kept by the rollback`, k, kL)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	c, _, _ := getTestClient()
+	c.cache.SetMsgKey("1", "gone")
+	c.cache.SetMsgLabels("1", []string{"INBOX"})
+	k, err := c.dir.DeliverRaw(strings.NewReader("X-GM-MSGID: 1\r\n"+labelsHeader+": INBOX\r\n\r\nbody\r\n"), "S")
+	if err != nil {
+		panic(err)
+	}
+	r, err := c.Verify(VerifyOptions{}, nil)
+	if err != nil {
+		t.Fatalf(`Verify() = %v, expected nil`, err)
+	}
+	kinds := make(map[ProblemKind]int)
+	for _, p := range r.Problems {
+		kinds[p.Kind]++
+	}
+	if len(r.Problems) != 2 || kinds[MissingFile] != 1 || kinds[OrphanFile] != 1 {
+		t.Fatalf(`Verify() found %v, expected a missing and an orphan file`, r.Problems)
+	}
+	if r, err = c.Verify(VerifyOptions{Repair: true}, nil); err != nil || r.Repaired() != 2 {
+		t.Fatalf(`Verify(Repair) = %v, %v, expected 2 repaired`, r.Problems, err)
+	}
+	if got, _, _ := c.cache.GetMsgKey("1"); got != k {
+		t.Errorf(`GetMsgKey("1") = %v after repair, expected %v`, got, k)
+	}
+	if r, err = c.Verify(VerifyOptions{Scrub: true}, nil); err != nil || len(r.Problems) != 0 {
+		t.Errorf(`Verify() after repair = %v, %v, expected no problems`, r.Problems, err)
+	}
+	fn, err := c.dir.GetFile(k)
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte("X-GM-MSGID: 1\r\n\r\nbodz\r\n"), 0600); err != nil {
+		panic(err)
+	}
+	if r, err = c.Verify(VerifyOptions{Scrub: true}, nil); err != nil || len(r.Problems) != 1 || r.Problems[0].Kind != Corrupt {
+		t.Errorf(`Verify(Scrub) of a modified file = %v, %v, expected it to be corrupt`, r.Problems, err)
+	}
+}
+
+func TestVerifyNotDownloaded(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "x1"}, {Id: "o2"}}}
+	svc.Metadata["o2"] = &gmail.Message{Id: "o2", HistoryId: 3, InternalDate: 1000}
+	c.cache.SetExcluded("x1")
+	r, err := c.Verify(VerifyOptions{Server: true}, nil)
+	if err != nil || len(r.Problems) != 1 || r.Problems[0].Kind != NotDownloaded || r.Problems[0].Id != "o2" {
+		t.Fatalf(`Verify(Server) = %v, %v, expected only o2 not downloaded`, r.Problems, err)
+	}
+	// o2 is older than the retention policy, so repair leaves it out.
+	c.retainSince = time.Unix(10, 0)
+	if r, err = c.Verify(VerifyOptions{Server: true, Repair: true}, nil); err != nil || r.Repaired() != 0 {
+		t.Errorf(`Verify(Server, Repair) = %v, %v, expected nothing repaired`, r.Problems, err)
+	}
+	if len(svc.Fetched) != 0 {
+		t.Errorf(`Verify(Server, Repair) downloaded %v, expected nothing`, svc.Fetched)
+	}
+}
+
+func TestVerifyOrphans(t *testing.T) {
+	c, _, _ := getTestClient()
+	deliver := func() maildir.Key {
+		k, err := c.dir.DeliverRaw(strings.NewReader("Message-Id: <stray@x>\r\n\r\nbody\r\n"), "S")
+		if err != nil {
+			panic(err)
+		}
+		return k
+	}
+	k := deliver()
+	if r, err := c.Verify(VerifyOptions{Repair: true}, nil); err != nil || len(r.Problems) != 1 || r.Repaired() != 0 {
+		t.Fatalf(`Verify(Repair) = %v, %v, expected an unrepaired orphan`, r.Problems, err)
+	}
+	q, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	if r, err := c.Verify(VerifyOptions{Repair: true, QuarantineDir: q}, nil); err != nil || r.Repaired() != 1 {
+		t.Fatalf(`Verify(Repair, QuarantineDir) = %v, %v, expected the orphan repaired`, r.Problems, err)
+	}
+	if _, err := c.dir.GetFile(k); err == nil {
+		t.Errorf(`Verify(Repair, QuarantineDir) left the orphan in the maildir`)
+	}
+	if fs, err := ioutil.ReadDir(q); err != nil || len(fs) != 1 {
+		t.Errorf(`Verify(Repair, QuarantineDir) moved %v files to the quarantine, %v, expected 1`, len(fs), err)
+	}
+	k = deliver()
+	if r, err := c.Verify(VerifyOptions{Repair: true, DropOrphans: true}, nil); err != nil || r.Repaired() != 1 {
+		t.Fatalf(`Verify(Repair, DropOrphans) = %v, %v, expected the orphan repaired`, r.Problems, err)
+	}
+	if _, err := c.dir.GetFile(k); err == nil {
+		t.Errorf(`Verify(Repair, DropOrphans) kept the orphan`)
+	}
+}
+
+func TestSpliceHeader(t *testing.T) {
+	raw := "Received: a\r\nX-Keywords: old,\r\n\tfolded\r\nSubject: hi\r\nx-keywords: other\r\n\r\nX-Keywords: body\r\n"
+	want := "X-Keywords: INBOX\r\nX-Keywords: UNREAD\r\nReceived: a\r\nSubject: hi\r\n\r\nX-Keywords: body\r\n"
+	if got := string(spliceHeader([]byte(raw), labelsHeader, []string{"INBOX", "UNREAD"})); got != want {
+		t.Errorf(`spliceHeader() = %q, expected %q`, got, want)
+	}
+	raw = "Subject: hi\n\nbody"
+	want = "X-GM-MSGID: 1\nSubject: hi\n\nbody"
+	if got := string(spliceHeader([]byte(raw), gmailIdHeader, []string{"1"})); got != want {
+		t.Errorf(`spliceHeader() = %q, expected %q`, got, want)
+	}
+}
+
+func TestRawFieldReader(t *testing.T) {
+	raw := base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody"))
+	js := "{\n  \"raw\": \"" + raw + "\"\n}\n"
+	r := base64.NewDecoder(base64.URLEncoding, &rawFieldReader{r: bufio.NewReaderSize(strings.NewReader(js), 16)})
+	bs, err := ioutil.ReadAll(r)
+	if err != nil || string(bs) != "Subject: hi\r\n\r\nbody" {
+		t.Errorf(`ReadAll(rawFieldReader) = %q, %v, expected the message`, bs, err)
+	}
+}
+
+func TestInternalDate(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Msgs["1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	o := msgOp{Id: "1", InternalDate: 1136214245000, Operation: ADD}
+	want := internalTime(o.InternalDate)
+	if err := c.getBody(&o); err != nil {
+		t.Fatalf(`getBody() = %v, expected nil`, err)
+	}
+	if !strings.HasPrefix(string(o.Key), "1136214245.") {
+		t.Errorf(`getBody() delivered %v, expected it to be named for %v`, o.Key, want)
+	}
+	if err := c.writeBatch(func(b *batch) error { return c.writeAdd(b, o) }); err != nil {
+		panic(err)
+	}
+	// A mail reader touching the file doesn't change the rewrite's date.
+	fn, err := c.dir.GetFile(o.Key)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chtimes(fn, time.Now(), time.Now()); err != nil {
+		panic(err)
+	}
+	if err := c.writeBatch(func(b *batch) error { return c.writeLabels(b, "1", []string{"INBOX"}) }); err != nil {
+		t.Fatalf(`writeLabels() = %v, expected nil`, err)
+	}
+	k, _, _ := c.cache.GetMsgKey("1")
+	if fn, err = c.dir.GetFile(k); err != nil {
+		panic(err)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		panic(err)
+	}
+	if !fi.ModTime().Equal(want) {
+		t.Errorf(`Rewritten message has mtime %v, expected %v`, fi.ModTime(), want)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	c, svc, _ := getTestClient()
+	c.dir = c.dir.WithCompression(maildir.Gzip)
+	svc.Msgs["1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	o := msgOp{Id: "1", Operation: ADD}
+	if err := c.getBody(&o); err != nil {
+		t.Fatalf(`getBody() = %v, expected nil`, err)
+	}
+	if err := c.writeBatch(func(b *batch) error { return c.writeAdd(b, o) }); err != nil {
+		panic(err)
+	}
+	fn, err := c.dir.GetFile(o.Key)
+	if err != nil {
+		panic(err)
+	}
+	if !strings.HasSuffix(fn, ":2,SZ") {
+		t.Errorf(`Compressed message delivered to %v, expected the Z flag`, fn)
+	}
+	if bs, err := ioutil.ReadFile(fn); err != nil || !strings.HasPrefix(string(bs), "\x1f\x8b") {
+		t.Errorf(`Compressed message file contains %q, %v, expected gzip`, bs, err)
+	}
+	m, r, err := c.getMaildirMessage(o.Key)
+	if err != nil || m.Header.Get("Subject") != "hi" {
+		t.Fatalf(`getMaildirMessage() = %v, %v, expected Subject: hi`, m, err)
+	}
+	r.Close()
+	if n, err := c.dir.WithCompression(maildir.NoCompression).Convert(false, nil); err != nil || n != 1 {
+		t.Fatalf(`Convert() = %v, %v, expected 1 message rewritten`, n, err)
+	}
+	if fn, err = c.dir.GetFile(o.Key); err != nil || !strings.HasSuffix(fn, ":2,S") {
+		t.Errorf(`Decompressed message is %v, %v, expected the Z flag to be cleared`, fn, err)
+	}
+	if r, err := c.Verify(VerifyOptions{Scrub: true}, nil); err != nil || len(r.Problems) != 0 {
+		t.Errorf(`Verify(Scrub) after decompressing = %v, %v, expected no problems`, r.Problems, err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	c, svc, _ := getTestClient()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		panic(err)
+	}
+	c.dir = c.dir.WithEncryption([]age.Recipient{id.Recipient()}, nil)
+	svc.Msgs["1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	o := msgOp{Id: "1", Operation: ADD}
+	if err := c.getBody(&o); err != nil {
+		t.Fatalf(`getBody() = %v, expected nil`, err)
+	}
+	if err := c.writeBatch(func(b *batch) error { return c.writeAdd(b, o) }); err != nil {
+		t.Fatalf(`writeAdd() without an identity = %v, expected nil`, err)
+	}
+	if _, _, err := c.getMaildirMessage(o.Key); err != maildir.ErrNoIdentity {
+		t.Errorf(`getMaildirMessage() without an identity = %v, expected %v`, err, maildir.ErrNoIdentity)
+	}
+	if err := c.writeBatch(func(b *batch) error { return c.writeLabels(b, "1", []string{"INBOX"}) }); err != nil {
+		t.Fatalf(`writeLabels() without an identity = %v, expected nil`, err)
+	}
+	if labels, _, _ := c.cache.GetMsgLabels("1"); !sameLabels(labels, []string{"INBOX"}) {
+		t.Errorf(`GetMsgLabels("1") = %v, expected [INBOX]`, labels)
+	}
+	c.dir = c.dir.WithEncryption(nil, []age.Identity{id})
+	m, r, err := c.getMaildirMessage(o.Key)
+	if err != nil || m.Header.Get("Subject") != "hi" {
+		t.Fatalf(`getMaildirMessage() = %v, %v, expected Subject: hi`, m, err)
+	}
+	r.Close()
+	if r, err := c.Verify(VerifyOptions{Scrub: true}, nil); err != nil || len(r.Problems) != 1 || r.Problems[0].Kind != LocalLabels {
+		t.Errorf(`Verify(Scrub) = %v, %v, expected the file's labels to be stale`, r.Problems, err)
+	}
+	// Relabeling with only the identity keeps the message encrypted.
+	if err := c.writeBatch(func(b *batch) error { return c.writeLabels(b, "1", []string{"INBOX", "UNREAD"}) }); err != nil {
+		t.Fatalf(`writeLabels() with an identity = %v, expected nil`, err)
+	}
+	k, _, _ := c.cache.GetMsgKey("1")
+	fn, err := c.dir.GetFile(k)
+	if err != nil {
+		panic(err)
+	}
+	if bs, err := ioutil.ReadFile(fn); err != nil || !strings.HasPrefix(string(bs), "age-encryption.org/v1\n") {
+		t.Errorf(`Relabeled message file contains %q, %v, expected it to be encrypted`, bs, err)
+	}
+	m, r, err = c.getMaildirMessage(k)
+	if err != nil || !sameLabels(m.Header[labelsHeader], []string{"INBOX", "UNREAD"}) {
+		t.Fatalf(`getMaildirMessage() after relabeling = %v, %v, expected labels [INBOX UNREAD]`, m, err)
+	}
+	r.Close()
+}
+
+func TestExport(t *testing.T) {
+	c, svc, dir := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "Label_1", Name: "Work"}}}
+	svc.Msgs["1"] = base64.URLEncoding.EncodeToString([]byte("From: a@example.com\r\nSubject: one\r\n\r\nFrom here\r\n>From there\r\n"))
+	svc.Msgs["2"] = base64.URLEncoding.EncodeToString([]byte("Subject: two\r\n\r\nbody\r\n"))
+	for id, labels := range map[string][]string{"1": {"INBOX", "Label_1"}, "2": {"INBOX"}} {
+		o := msgOp{Id: id, Labels: labels, InternalDate: 1136214245000, Operation: ADD}
+		if err := c.getBody(&o); err != nil {
+			panic(err)
+		}
+		if err := c.writeBatch(func(b *batch) error { return c.writeAdd(b, o) }); err != nil {
+			panic(err)
+		}
+	}
+	out := path.Join(dir, "export.mbox")
+	n, err := c.Export(out, ExportOptions{Format: MboxFormat, Query: "label:Work"}, nil)
+	if err != nil || n != 1 {
+		t.Fatalf(`Export(label:Work) = %v, %v, expected 1 message`, n, err)
+	}
+	bs, err := ioutil.ReadFile(out)
+	if err != nil {
+		panic(err)
+	}
+	want := "From a@example.com Mon Jan  2 15:04:05 2006\nX-Gmail-Labels: INBOX,Work\nX-Keywords: INBOX\nX-Keywords: Label_1\nFrom: a@example.com\nSubject: one\n\n>From here\n>>From there\n\n"
+	if string(bs) != want {
+		t.Errorf(`Export(label:Work) wrote %q, expected %q`, bs, want)
+	}
+	if n, err := c.Export(path.Join(dir, "export"), ExportOptions{Format: EmlFormat, Before: internalTime(1136214245000)}, nil); err != nil || n != 0 {
+		t.Errorf(`Export(Before) = %v, %v, expected no messages`, n, err)
+	}
+	// The date in the cache wins over the message's headers.
+	c.cache.SetMsgDate("2", 1167750245000)
+	if n, err := c.Export(path.Join(dir, "later"), ExportOptions{Format: EmlFormat, After: internalTime(1167750245000)}, nil); err != nil || n != 1 {
+		t.Errorf(`Export(After) = %v, %v, expected 1 message`, n, err)
+	}
+	// Messages that can't be parsed are skipped.
+	k, _, _ := c.cache.GetMsgKey("1")
+	fn, err := c.dir.GetFile(k)
+	if err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte("not a header\r\n"), 0600); err != nil {
+		panic(err)
+	}
+	if n, err := c.Export(path.Join(dir, "skipped"), ExportOptions{Format: EmlFormat}, nil); err != nil || n != 1 {
+		t.Errorf(`Export() with an unparsable message = %v, %v, expected 1 message`, n, err)
+	}
+}
+
+func TestJoinLabelNames(t *testing.T) {
+	names := []string{"Inbox", "Work, Home", `Say "hi"`}
+	v := joinLabelNames(names)
+	if want := `Inbox,"Work, Home","Say ""hi"""`; v != want {
+		t.Errorf(`joinLabelNames(%q) = %v, expected %v`, names, v, want)
+	}
+	byName := map[string]string{"Work, Home": "Label_1", `Say "hi"`: "Label_2"}
+	if ids := takeoutLabels(v, byName); strings.Join(ids, " ") != "INBOX Label_1 Label_2" {
+		t.Errorf(`takeoutLabels(%v) = %v, expected [INBOX Label_1 Label_2]`, v, ids)
+	}
+}
+
+func TestMboxReader(t *testing.T) {
+	mbox := "From a Mon Jan  2 15:04:05 2006\nSubject: one\n\n>From here\n>>From there\n\nFrom b Mon Jan  2 15:04:05 2006\nSubject: two\n\nbody\n"
+	r, err := newMboxReader(strings.NewReader(mbox))
+	if err != nil {
+		t.Fatalf(`newMboxReader() = %v, expected nil`, err)
+	}
+	want := [][2]string{
+		{"From a Mon Jan  2 15:04:05 2006", "Subject: one\n\nFrom here\n>From there\n"},
+		{"From b Mon Jan  2 15:04:05 2006", "Subject: two\n\nbody\n"},
+	}
+	for _, w := range want {
+		from, m, ok := r.Next()
+		if !ok {
+			t.Fatalf(`Next() = false, expected %q`, w[0])
+		}
+		bs, err := ioutil.ReadAll(m)
+		if from != w[0] || string(bs) != w[1] || err != nil {
+			t.Errorf(`Next() = %q, %q, %v, expected %q, %q`, from, bs, err, w[0], w[1])
+		}
+	}
+	if _, _, ok := r.Next(); ok {
+		t.Errorf(`Next() = true at the end of the mbox, expected false`)
+	}
+}
+
+func TestRebuildCache(t *testing.T) {
+	c, svc, _ := getTestClient()
+	deliver := func(body string) maildir.Key {
+		k, err := c.dir.DeliverRaw(strings.NewReader(body), "S")
+		if err != nil {
+			panic(err)
+		}
+		return k
+	}
+	// One local message carries its Gmail ID, another only its Message-Id.
+	kA := deliver("Message-Id: <a@x>\r\n" + gmailIdHeader + ": " + formatGmailIdHeader("a1") + "\r\n\r\na\r\n")
+	kB := deliver("Message-Id: <b@x>\r\n\r\nb\r\n")
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "a1"}, {Id: "b2"}, {Id: "c3"}}}
+	svc.Metadata["a1"] = &gmail.Message{Id: "a1", HistoryId: 5, InternalDate: 1000}
+	svc.Metadata["b2"] = &gmail.Message{Id: "b2", HistoryId: 9, Payload: &gmail.MessagePart{
+		Headers: []*gmail.MessagePartHeader{{Name: "Message-ID", Value: "<b@x>"}}}}
+	svc.Metadata["c3"] = &gmail.Message{Id: "c3", HistoryId: 3}
+	svc.Msgs["c3"] = base64.URLEncoding.EncodeToString([]byte("Message-Id: <c@x>\r\n\r\nc\r\n"))
+	if err := c.RebuildCache(nil); err != nil {
+		t.Fatalf(`RebuildCache() = %v, expected nil`, err)
+	}
+	if len(svc.Fetched) != 1 || svc.Fetched[0] != "c3" {
+		t.Errorf(`RebuildCache() downloaded %v, expected only [c3]`, svc.Fetched)
+	}
+	for id, want := range map[string]maildir.Key{"a1": kA, "b2": kB} {
+		if k, ok, err := c.cache.GetMsgKey(id); err != nil || !ok || k != want {
+			t.Errorf(`GetMsgKey(%q) = %v, %v, %v, expected the local message %v`, id, k, ok, err, want)
+		}
+	}
+	if _, ok, err := c.cache.GetMsgKey("c3"); err != nil || !ok {
+		t.Errorf(`GetMsgKey("c3") = %v, %v, expected the downloaded message`, ok, err)
+	}
+	if d, ok, err := c.cache.GetMsgDate("a1"); err != nil || !ok || !d.Equal(internalTime(1000)) {
+		t.Errorf(`GetMsgDate("a1") = %v, %v, %v, expected %v`, d, ok, err, internalTime(1000))
+	}
+	if i, err := c.cache.GetHistoryIdx(); err != nil || i != 9 {
+		t.Errorf(`GetHistoryIdx() = %v, %v, expected 9`, i, err)
+	}
+}
+
+func TestImportTakeout(t *testing.T) {
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "Label_1", Name: "Work"}}}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "4d2"}}}
+	svc.Metadata["4d2"] = &gmail.Message{Id: "4d2", HistoryId: 7, LabelIds: []string{"INBOX", "Label_1"}}
+	mbox := "From 1234@xxx Mon Jan 02 15:04:05 +0000 2006\r\nX-GM-THRID: 1234\r\nX-Gmail-Labels: Inbox,Opened,Work\r\nSubject: hi\r\n\r\nbody\r\n"
+	if err := c.ImportTakeout(strings.NewReader(mbox), int64(len(mbox)), nil); err != nil {
+		t.Fatalf(`ImportTakeout() = %v, expected nil`, err)
+	}
+	k, ok, err := c.cache.GetMsgKey("4d2")
+	if err != nil || !ok {
+		t.Fatalf(`GetMsgKey("4d2") = %v, %v after import, expected a key`, ok, err)
+	}
+	if labels, _, _ := c.cache.GetMsgLabels("4d2"); !sameLabels(labels, []string{"INBOX", "Label_1"}) {
+		t.Errorf(`GetMsgLabels("4d2") = %v, expected [INBOX Label_1]`, labels)
+	}
+	if i, err := c.cache.GetHistoryIdx(); err != nil || i != 7 {
+		t.Errorf(`GetHistoryIdx() = %v, %v, expected 7`, i, err)
+	}
+	if !strings.HasPrefix(string(k), "1136214245.") {
+		t.Errorf(`Imported message %v, expected it dated by its "From " line`, k)
+	}
+	// A message already in the maildir isn't imported again, even once the
+	// cache forgot it.
+	c.cache.DelMsg("4d2")
+	if err := c.ImportTakeout(strings.NewReader(mbox), int64(len(mbox)), nil); err != nil {
+		t.Fatalf(`ImportTakeout() again = %v, expected nil`, err)
+	}
+	n := 0
+	c.dir.Walk(func(maildir.Message) error { n++; return nil })
+	if n != 1 {
+		t.Errorf(`ImportTakeout() again left %d messages, expected 1`, n)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	SyncThreads = true
+	defer func() { SyncThreads = false }()
+	c, svc, _ := getTestClient()
+	c.label = "Work"
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "Label_1", Name: "Work"}}}
+	svc.Threads[""] = &gmail.ListThreadsResponse{Threads: []*gmail.Thread{{Id: "a1"}}}
+	svc.Thread["a1"] = &gmail.Thread{Id: "a1", Messages: []*gmail.Message{{Id: "a1"}, {Id: "a2"}}}
+	for i, id := range []string{"a1", "a2", "a3", "b1"} {
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{Id: id, ThreadId: id[:1] + "1", HistoryId: uint64(i + 1)}
+	}
+	// Only the first message of the thread has the label.
+	svc.Metadata["a1"].LabelIds = []string{"Label_1"}
+	if err := c.Sync(true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	files, err := c.ThreadFiles("a2")
+	if err != nil || len(files) != 2 {
+		t.Fatalf(`ThreadFiles("a2") = %v, %v, expected 2 files`, files, err)
+	}
+	if h, err := c.readHeader(files[0]); err != nil || h.Get(threadIdHeader) != "161" {
+		t.Errorf(`%v has %v %v, %v, expected 161`, files[0], threadIdHeader, h.Get(threadIdHeader), err)
+	}
+	// A reply in the thread is synced, a message in another thread isn't.
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id: 4,
+			MessagesAdded: []*gmail.HistoryMessageAdded{
+				{Message: &gmail.Message{Id: "a3", ThreadId: "a1"}},
+				{Message: &gmail.Message{Id: "b1", ThreadId: "b1"}},
+			},
+		}},
+		HistoryId: 4,
+	}
+	if err := c.Sync(false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	threads, err := c.Threads()
+	if err != nil || len(threads) != 1 || threads[0].Id != "a1" || len(threads[0].Msgs) != 3 {
+		t.Errorf(`Threads() = %v, %v, expected thread a1 with 3 messages`, threads, err)
+	}
+	if _, ok, _ := c.cache.GetMsgKey("b1"); ok {
+		t.Errorf(`GetMsgKey("b1") = true, expected b1 not to be synced`)
+	}
+	// A message of another thread gains the label, bringing in its thread.
+	svc.Thread["c1"] = &gmail.Thread{Id: "c1", Messages: []*gmail.Message{{Id: "c1"}, {Id: "c2"}}}
+	for i, id := range []string{"c1", "c2"} {
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{Id: id, ThreadId: "c1", HistoryId: uint64(i + 5)}
+	}
+	svc.Metadata["c2"].LabelIds = []string{"Label_1"}
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id:          6,
+			LabelsAdded: []*gmail.HistoryLabelAdded{{Message: &gmail.Message{Id: "c2", ThreadId: "c1"}, LabelIds: []string{"Label_1"}}},
+		}},
+		HistoryId: 6,
+	}
+	if err := c.Sync(false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if files, err := c.ThreadFiles("c1"); err != nil || len(files) != 2 {
+		t.Errorf(`ThreadFiles("c1") = %v, %v, expected the whole thread to be synced`, files, err)
+	}
+	// A missing file doesn't hide the rest of the thread.
+	k, _, _ := c.cache.GetMsgKey("c1")
+	if err := c.dir.Delete(k); err != nil {
+		panic(err)
+	}
+	if files, err := c.ThreadFiles("c1"); err != nil || len(files) != 1 {
+		t.Errorf(`ThreadFiles("c1") with a missing file = %v, %v, expected the other file`, files, err)
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	c, svc, dir := getTestClient()
+	c.features = Drafts
+	svc.Msgs["m0"] = base64.URLEncoding.EncodeToString([]byte("Subject: first\r\n\r\nbody\r\n"))
+	svc.Drafts["d1"] = "m0"
+	if err := c.SyncDrafts(); err != nil {
+		t.Fatalf(`SyncDrafts() = %v, expected nil`, err)
+	}
+	cur := path.Join(dir, draftsFolder, "cur")
+	fs, err := ioutil.ReadDir(cur)
+	if err != nil || len(fs) != 1 || !strings.HasSuffix(fs[0].Name(), ":2,DS") {
+		t.Fatalf(`ReadDir(%v) = %v, %v, expected one draft with flags DS`, cur, fs, err)
+	}
+	old := path.Join(cur, fs[0].Name())
+	bs, err := ioutil.ReadFile(old)
+	if err != nil || !strings.Contains(string(bs), draftIdHeader+": d1") {
+		t.Fatalf(`Draft %v = %q, %v, expected it to carry its draft ID`, old, bs, err)
+	}
+	// A mail reader saves an edited copy of d1 as a new file, and writes a
+	// new draft.
+	os.Remove(old)
+	edited := strings.Replace(string(bs), "first", "edited", 1)
+	if err := ioutil.WriteFile(path.Join(cur, "1.edited.host:2,DS"), []byte(edited), 0600); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path.Join(cur, "2.new.host:2,D"), []byte("Subject: second\r\n\r\nbody\r\n"), 0600); err != nil {
+		panic(err)
+	}
+	if err := c.SyncDrafts(); err != nil {
+		t.Fatalf(`SyncDrafts() = %v, expected nil`, err)
+	}
+	if len(svc.Drafts) != 2 || svc.Drafts["d1"] == "m0" {
+		t.Errorf(`Drafts after upload = %v, expected d1 updated and a new draft`, svc.Drafts)
+	}
+	for _, raw := range svc.Uploaded {
+		if strings.Contains(string(raw), draftIdHeader) {
+			t.Errorf(`Uploaded %q, expected no %v header`, raw, draftIdHeader)
+		}
+	}
+	if s, ok, err := c.cache.GetDraft("d1"); err != nil || !ok || s.MsgId != svc.Drafts["d1"] {
+		t.Errorf(`GetDraft("d1") = %v, %v, %v, expected message %v`, s, ok, err, svc.Drafts["d1"])
+	}
+	// d1 is sent from Gmail.
+	delete(svc.Drafts, "d1")
+	n := len(svc.Uploaded)
+	if err := c.SyncDrafts(); err != nil {
+		t.Fatalf(`SyncDrafts() = %v, expected nil`, err)
+	}
+	if fs, err := ioutil.ReadDir(cur); err != nil || len(fs) != 1 {
+		t.Errorf(`ReadDir(%v) = %v, %v, expected one draft left`, cur, fs, err)
+	}
+	if len(svc.Uploaded) != n {
+		t.Errorf(`SyncDrafts() uploaded unchanged drafts`)
+	}
+}
+
+func TestDraftCopies(t *testing.T) {
+	SyncDrafts = true
+	defer func() { SyncDrafts = false }()
+	c, svc, dir := getTestClient()
+	c.features = Drafts
+	c.dir = c.dir.WithCompression(maildir.Gzip)
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Msgs["m1"] = base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	// m1 was synced as an ordinary message before drafts were synced.
+	o := msgOp{Id: "m1", Labels: []string{draftLabel}, Operation: ADD}
+	if err := c.getBody(&o); err != nil {
+		t.Fatalf(`getBody() = %v, expected nil`, err)
+	}
+	if err := c.writeBatch(func(b *batch) error { return c.writeAdd(b, o) }); err != nil {
+		panic(err)
+	}
+	svc.Drafts["d1"] = "m1"
+	if err := c.SyncDrafts(); err != nil {
+		t.Fatalf(`SyncDrafts() = %v, expected nil`, err)
+	}
+	if _, ok, _ := c.cache.GetMsgKey("m1"); ok {
+		t.Errorf(`GetMsgKey("m1") = true, expected the copy of draft m1 to be removed`)
+	}
+	cur := path.Join(dir, draftsFolder, "cur")
+	fs, err := ioutil.ReadDir(cur)
+	if err != nil || len(fs) != 1 || !strings.HasSuffix(fs[0].Name(), ":2,DSZ") {
+		t.Fatalf(`ReadDir(%v) = %v, %v, expected one compressed draft`, cur, fs, err)
+	}
+	if err := c.SyncDrafts(); err != nil || len(svc.Uploaded) != 0 {
+		t.Errorf(`SyncDrafts() = %v and uploaded %d drafts, expected the compressed draft to be unchanged`, err, len(svc.Uploaded))
+	}
+	// m1 is sent, losing its DRAFT label, and is synced as a message.
+	delete(svc.Drafts, "d1")
+	if err := c.cache.SetHistoryIdx(1); err != nil {
+		panic(err)
+	}
+	svc.Metadata["m1"] = &gmail.Message{Id: "m1", HistoryId: 2, LabelIds: []string{sentLabel}}
+	svc.History[""] = &gmail.ListHistoryResponse{
+		History: []*gmail.History{{
+			Id:            2,
+			LabelsAdded:   []*gmail.HistoryLabelAdded{{Message: &gmail.Message{Id: "m1"}, LabelIds: []string{sentLabel}}},
+			LabelsRemoved: []*gmail.HistoryLabelRemoved{{Message: &gmail.Message{Id: "m1"}, LabelIds: []string{draftLabel}}},
+		}},
+		HistoryId: 2,
+	}
+	if err := c.Sync(false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if labels, ok, _ := c.cache.GetMsgLabels("m1"); !ok || !sameLabels(labels, []string{sentLabel}) {
+		t.Errorf(`GetMsgLabels("m1") = %v, %v, expected the sent draft to be synced`, labels, ok)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	MaxMessageSize = 100
+	defer func() { MaxMessageSize = 0 }()
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{Id: "0x1", HistoryId: 1, SizeEstimate: 1000}
+	attachment := bytes.Repeat([]byte("attachment"), 100)
+	svc.Attachments["att"] = attachment
+	text := "see attached\r\n" + strippedPartHeader + ": 0\r\n"
+	svc.Full["0x1"] = &gmail.Message{Id: "0x1", Payload: &gmail.MessagePart{
+		PartId:  "",
+		Headers: []*gmail.MessagePartHeader{{Name: "Subject", Value: "big"}, {Name: "Content-Type", Value: `multipart/mixed; boundary="b"`}},
+		Parts: []*gmail.MessagePart{{
+			PartId:  "0",
+			Headers: []*gmail.MessagePartHeader{{Name: "Content-Type", Value: "text/plain"}},
+			// Quoting a placeholder's header doesn't make a placeholder.
+			Body: &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(text)), Size: int64(len(text))},
+		}, {
+			PartId:   "1",
+			MimeType: "application/octet-stream",
+			Filename: "a.bin",
+			Headers:  []*gmail.MessagePartHeader{{Name: "Content-Type", Value: "application/octet-stream"}, {Name: "Content-Transfer-Encoding", Value: "base64"}},
+			Body:     &gmail.MessagePartBody{AttachmentId: "att", Size: int64(len(attachment))},
+		}},
+	}}
+	if err := c.Sync(true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	parts := func() map[string][]byte {
+		k, _, _ := c.cache.GetMsgKey("0x1")
+		m, f, err := c.getMaildirMessage(k)
+		if err != nil {
+			t.Fatalf(`getMaildirMessage(%v) = %v, expected nil`, k, err)
+		}
+		defer f.Close()
+		_, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+		ps := make(map[string][]byte)
+		r := multipart.NewReader(m.Body, params["boundary"])
+		for i := 0; ; i++ {
+			p, err := r.NextPart()
+			if err == io.EOF {
+				return ps
+			} else if err != nil {
+				t.Fatalf(`NextPart() = %v, expected nil`, err)
+			}
+			bs, _ := ioutil.ReadAll(p)
+			if p.Header.Get(strippedPartHeader) != "" {
+				bs = []byte(strippedPartHeader)
+			}
+			ps[fmt.Sprint(i)] = bs
+		}
+	}
+	if ps := parts(); string(ps["0"]) != text || string(ps["1"]) != strippedPartHeader {
+		t.Errorf(`Stripped message has parts %q, expected the text and a placeholder`, ps)
+	}
+	if _, err := c.FetchAttachments("0x1", []string{"0"}); err == nil {
+		t.Error(`FetchAttachments("0x1", [0]) = nil, expected part 0 not to be stripped`)
+	}
+	if n, err := c.FetchAttachments("0x1", nil); err != nil || n != 1 {
+		t.Fatalf(`FetchAttachments("0x1", nil) = %v, %v, expected 1, nil`, n, err)
+	}
+	ps := parts()
+	if bs, err := base64.StdEncoding.DecodeString(strings.Replace(string(ps["1"]), "\r\n", "", -1)); err != nil || !bytes.Equal(bs, attachment) {
+		t.Errorf(`Fetched attachment = %q, %v, expected %q`, bs, err, attachment)
+	}
+}
+
+func TestMaxMessageSizeSinglePart(t *testing.T) {
+	MaxMessageSize = 100
+	defer func() { MaxMessageSize = 0 }()
+	c, svc, _ := getTestClient()
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}}}
+	svc.Metadata["0x1"] = &gmail.Message{Id: "0x1", HistoryId: 1, SizeEstimate: 1000}
+	attachment := bytes.Repeat([]byte("attachment"), 100)
+	svc.Attachments["att"] = attachment
+	svc.Full["0x1"] = &gmail.Message{Id: "0x1", Payload: &gmail.MessagePart{
+		MimeType: "application/pdf",
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: "a@example.com"},
+			{Name: "Subject", Value: "big"},
+			{Name: "Message-Id", Value: "<big@example.com>"},
+			{Name: "Content-Type", Value: "application/pdf"},
+			{Name: "Content-Transfer-Encoding", Value: "base64"},
+		},
+		Body: &gmail.MessagePartBody{AttachmentId: "att", Size: int64(len(attachment))},
+	}}
+	if err := c.Sync(true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	k, _, _ := c.cache.GetMsgKey("0x1")
+	m, f, err := c.getMaildirMessage(k)
+	if err != nil {
+		t.Fatalf(`getMaildirMessage(%v) = %v, expected nil`, k, err)
+	}
+	f.Close()
+	for h, v := range map[string]string{"From": "a@example.com", "Subject": "big", "Message-Id": "<big@example.com>", "Content-Type": "text/plain; charset=utf-8"} {
+		if got := m.Header.Get(h); got != v {
+			t.Errorf(`Stripped message has %v %q, expected %q`, h, got, v)
+		}
+	}
+	if _, ok := m.Header[strippedPartHeader]; !ok {
+		t.Errorf(`Stripped message has no %v header, expected a placeholder`, strippedPartHeader)
+	}
+	if n, err := c.FetchAttachments("0x1", nil); err != nil || n != 1 {
+		t.Fatalf(`FetchAttachments("0x1", nil) = %v, %v, expected 1, nil`, n, err)
+	}
+	k, _, _ = c.cache.GetMsgKey("0x1")
+	m, f, err = c.getMaildirMessage(k)
+	if err != nil {
+		t.Fatalf(`getMaildirMessage(%v) = %v, expected nil`, k, err)
+	}
+	defer f.Close()
+	bs, _ := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, m.Body))
+	if m.Header.Get("Subject") != "big" || !bytes.Equal(bs, attachment) {
+		t.Errorf(`Fetched message = %v, %q, expected the subject and the attachment`, m.Header, bs)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	RetainNewerThan = "2020-01-01"
+	defer func() { RetainNewerThan, RetainPerLabel = "", 0 }()
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	svc.Labels = &gmail.ListLabelsResponse{}
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x1"}, {Id: "0x2"}, {Id: "0x3"}}}
+	for i, y := range []int{2019, 2021, 2022} {
+		id := fmt.Sprintf("0x%d", i+1)
+		svc.Msgs[id] = m
+		date := time.Date(y, 6, 1, 0, 0, 0, 0, time.UTC)
+		svc.Metadata[id] = &gmail.Message{Id: id, HistoryId: uint64(i + 1), InternalDate: date.UnixNano() / int64(time.Millisecond), LabelIds: []string{"INBOX"}}
+	}
+	cached := func() []string {
+		var ids []string
+		for _, id := range []string{"0x1", "0x2", "0x3"} {
+			if _, ok, _ := c.cache.GetMsgKey(id); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	if err := c.Sync(true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	if ids := cached(); strings.Join(ids, " ") != "0x2 0x3" {
+		t.Errorf(`Cached %v with --newer-than 2020-01-01, expected [0x2 0x3]`, ids)
+	}
+	if ok, err := c.cache.IsExcluded("0x1"); err != nil || !ok {
+		t.Errorf(`IsExcluded("0x1") = %v, %v, expected true`, ok, err)
+	}
+	// Keeping one message per label removes the older one, by the date Gmail
+	// received it, even if a mail reader touched its file since.
+	k, _, _ := c.cache.GetMsgKey("0x2")
+	fn, err := c.dir.GetFile(k)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chtimes(fn, time.Now(), time.Now()); err != nil {
+		panic(err)
+	}
+	RetainPerLabel = 1
+	svc.History[""] = &gmail.ListHistoryResponse{HistoryId: 3}
+	if err := c.Sync(false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if ids := cached(); strings.Join(ids, " ") != "0x3" {
+		t.Errorf(`Cached %v with --per-label 1, expected [0x3]`, ids)
+	}
+	// Widening the policy fetches the excluded messages again.
+	RetainNewerThan, RetainPerLabel = "", 0
+	if err := c.Sync(false, nil); err != nil {
+		t.Fatalf(`Sync(false, nil) = %v, expected nil`, err)
+	}
+	if ids := cached(); len(ids) != 3 {
+		t.Errorf(`Cached %v after widening the policy, expected all messages`, ids)
+	}
+}
+
+func TestRetentionPerLabelFull(t *testing.T) {
+	RetainPerLabel = 1
+	defer func() { RetainPerLabel = 0 }()
+	c, svc, _ := getTestClient()
+	m := base64.URLEncoding.EncodeToString([]byte("Subject: hi\r\n\r\nbody\r\n"))
+	svc.Labels = &gmail.ListLabelsResponse{Labels: []*gmail.Label{{Id: "INBOX"}}}
+	// Newest first, as Gmail lists them; 0x3 and 0x4 have no label.
+	svc.Messages[""] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x2"}, {Id: "0x3"}, {Id: "0x1"}, {Id: "0x4"}}}
+	svc.LabelMessages["INBOX"] = &gmail.ListMessagesResponse{Messages: []*gmail.Message{{Id: "0x2"}, {Id: "0x1"}}}
+	for i, id := range []string{"0x1", "0x2", "0x3", "0x4"} {
+		svc.Msgs[id] = m
+		svc.Metadata[id] = &gmail.Message{Id: id, HistoryId: uint64(i + 1), InternalDate: int64(i + 1)}
+	}
+	svc.Metadata["0x1"].LabelIds = []string{"INBOX"}
+	svc.Metadata["0x2"].LabelIds = []string{"INBOX"}
+	svc.Metadata["0x4"].InternalDate = 0
+	if err := c.Sync(true, nil); err != nil {
+		t.Fatalf(`Sync(true, nil) = %v, expected nil`, err)
+	}
+	sort.Strings(svc.Fetched)
+	if strings.Join(svc.Fetched, " ") != "0x2 0x3" {
+		t.Errorf(`Sync(true, nil) with --per-label 1 downloaded %v, expected [0x2 0x3]`, svc.Fetched)
+	}
+	for _, id := range []string{"0x1", "0x4"} {
+		if ok, err := c.cache.IsExcluded(id); err != nil || !ok {
+			t.Errorf(`IsExcluded(%q) = %v, %v, expected true`, id, ok, err)
+		}
+	}
+}
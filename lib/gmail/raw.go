@@ -0,0 +1,105 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/textproto"
+)
+
+// maxHeaderSize bounds the size of the header block read into memory while
+// delivering a message.
+const maxHeaderSize = 1 << 20
+
+// headerEdit replaces a header field in a delivered message.
+type headerEdit struct {
+	name string
+	vs   []string
+}
+
+// readHeaderBlock reads the header of the message from r, up to and including
+// the blank line ending it, leaving the body in r.
+func readHeaderBlock(r *bufio.Reader) ([]byte, error) {
+	var h []byte
+	partial := false // Whether the last read stopped mid-line.
+	for {
+		line, err := r.ReadSlice('\n')
+		h = append(h, line...)
+		if len(h) > maxHeaderSize {
+			return nil, errors.New("message header too large")
+		}
+		if err == bufio.ErrBufferFull {
+			partial = true
+			continue
+		} else if err == io.EOF {
+			return h, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if !partial && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return h, nil
+		}
+		partial = false
+	}
+}
+
+// headerEnd returns the length of the header block of raw, including the
+// blank line ending it, and the line ending the header uses.
+func headerEnd(raw []byte) (int, []byte) {
+	eol := []byte("\n")
+	if i := bytes.IndexByte(raw, '\n'); i > 0 && raw[i-1] == '\r' {
+		eol = []byte("\r\n")
+	}
+	for i := 0; i < len(raw); {
+		j := bytes.IndexByte(raw[i:], '\n')
+		if j < 0 {
+			return len(raw), eol
+		}
+		line := raw[i : i+j+1]
+		i += j + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return i, eol
+		}
+	}
+	return len(raw), eol
+}
+
+// spliceHeader replaces every occurrence of header name in the raw message
+// with a line for each of vs, leaving the rest of the message untouched so
+// that header order, folding and signatures survive. The new lines go at the
+// top of the header, and use the same line endings as the rest of it.
+func spliceHeader(raw []byte, name string, vs []string) []byte {
+	n, eol := headerEnd(raw)
+	key := textproto.CanonicalMIMEHeaderKey(name)
+	out := make([]byte, 0, len(raw)+len(vs)*(len(name)+32))
+	for _, v := range vs {
+		out = append(out, name+": "+v...)
+		out = append(out, eol...)
+	}
+	skipping := false
+	for i := 0; i < n; {
+		j := bytes.IndexByte(raw[i:n], '\n')
+		end := n
+		if j >= 0 {
+			end = i + j + 1
+		}
+		line := raw[i:end]
+		i = end
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			// A continuation of the previous field.
+			if !skipping {
+				out = append(out, line...)
+			}
+			continue
+		}
+		skipping = false
+		if c := bytes.IndexByte(line, ':'); c > 0 {
+			skipping = textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(line[:c]))) == key
+		}
+		if !skipping {
+			out = append(out, line...)
+		}
+	}
+	return append(out, raw[n:]...)
+}
@@ -0,0 +1,190 @@
+package gmail
+
+import (
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/meelapshah/outtake/lib"
+	"github.com/meelapshah/outtake/lib/maildir"
+	"google.golang.org/api/googleapi"
+)
+
+// localMessages indexes the maildir messages that haven't been matched to a
+// Gmail message yet.
+type localMessages struct {
+	sync.Mutex
+	byGmailId   map[string]maildir.Key
+	byMessageId map[string][]maildir.Key
+	headers     map[maildir.Key]mail.Header
+}
+
+// match claims the local message for the Gmail message id with Message-Id
+// mId, if there is one.
+func (l *localMessages) match(id, mId string) (maildir.Key, mail.Header, bool) {
+	l.Lock()
+	defer l.Unlock()
+	k, ok := l.byGmailId[id]
+	if ok {
+		delete(l.byGmailId, id)
+	} else if ks := l.byMessageId[mId]; mId != "" && len(ks) > 0 {
+		k, ok = ks[0], true
+		l.byMessageId[mId] = ks[1:]
+	}
+	if !ok {
+		return "", nil, false
+	}
+	h := l.headers[k]
+	delete(l.headers, k)
+	return k, h, true
+}
+
+// parseGmailIdHeader converts the decimal message ID found in an X-GM-MSGID
+// header to the hex form used by the Gmail API.
+func parseGmailIdHeader(v string) (string, bool) {
+	n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatUint(n, 16), true
+}
+
+// scanMaildir reads the headers of every message in the maildir.
+func (g *Gmail) scanMaildir() (*localMessages, error) {
+	l := &localMessages{
+		byGmailId:   make(map[string]maildir.Key),
+		byMessageId: make(map[string][]maildir.Key),
+		headers:     make(map[maildir.Key]mail.Header),
+	}
+	err := g.dir.Walk(func(f maildir.Message) error {
+		h, err := g.readHeader(f.Path)
+		if err != nil {
+			log.Println("Couldn't read maildir message", f.Key, ":", err)
+			return nil
+		}
+		l.headers[f.Key] = h
+		if id, ok := parseGmailIdHeader(h.Get(gmailIdHeader)); ok {
+			l.byGmailId[id] = f.Key
+		} else if mId, ok := getMessageId(&mail.Message{Header: h}); ok {
+			l.byMessageId[mId] = append(l.byMessageId[mId], f.Key)
+		}
+		return nil
+	})
+	return l, err
+}
+
+// matchMsg looks for a local copy of the Gmail message id, and downloads the
+// message if there isn't one.
+func (g *Gmail) matchMsg(local *localMessages, id string) msgOp {
+	o := msgOp{Id: id}
+	meta, err := g.svc.GetMetadata(id)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+		// Deleted since we listed it.
+		return o
+	} else if err != nil {
+		o.Error = err
+		return o
+	}
+	mId := ""
+	if meta.Payload != nil {
+		for _, h := range meta.Payload.Headers {
+			if strings.EqualFold(h.Name, "Message-Id") {
+				mId = strings.Trim(h.Value, "<> ")
+			}
+		}
+	}
+	if k, h, ok := local.match(id, mId); ok {
+		o.Operation = MATCH
+		o.Key = k
+		o.Msg = &mail.Message{Header: h}
+		o.Labels = meta.LabelIds
+		o.HistoryId = meta.HistoryId
+		o.ThreadId = meta.ThreadId
+		o.Size = meta.SizeEstimate
+		o.InternalDate = meta.InternalDate
+		return o
+	}
+	return g.handleNewMsg(id)
+}
+
+// writeMatch records a local message matched to a Gmail message in the cache,
+// and rewrites it if its labels are out of date.
+func (g *Gmail) writeMatch(b *batch, o msgOp) error {
+	labels := o.Msg.Header[labelsHeader]
+	if err := b.cache.SetMsgKey(o.Id, o.Key); err != nil {
+		return err
+	}
+	if err := b.cache.SetMsgLabels(o.Id, labels); err != nil {
+		return err
+	}
+	if err := g.recordDigest(b, o.Id, o.Key, o.Size); err != nil {
+		return err
+	}
+	if o.InternalDate > 0 {
+		if err := b.cache.SetMsgDate(o.Id, o.InternalDate); err != nil {
+			return err
+		}
+	}
+	if mId, err := g.messageIdForKey(o.Key, o.Msg); err != nil {
+		return err
+	} else if err := b.cache.SetIds(o.Id, mId); err != nil {
+		return err
+	}
+	if err := setGmailLabels(b, o.Id, o.Labels); err != nil {
+		return err
+	}
+	if !sameLabels(labels, o.Labels) {
+		return g.writeLabels(b, o.Id, o.Labels)
+	}
+	return nil
+}
+
+// RebuildCache repopulates the cache from the messages already in the
+// maildir, so that losing the cache doesn't mean downloading everything
+// again. Local messages are matched to Gmail messages by their X-GM-MSGID
+// header when they have one, and by Message-Id otherwise; only Gmail messages
+// without a local match are downloaded.
+func (g *Gmail) RebuildCache(progress chan<- lib.Progress) error {
+	g.progress = progress
+	if err := g.resolveLabel(); err != nil {
+		return err
+	}
+	log.Println("Scanning maildir.")
+	local, err := g.scanMaildir()
+	if err != nil {
+		return err
+	}
+	log.Println("Matching", len(local.headers), "local messages with Gmail.")
+	newMsgs := make(chan string, MessageBufferSize)
+	ops := make(chan msgOp, MessageBufferSize)
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < ConcurrentDownloads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range newMsgs {
+				if !stopped(done) {
+					ops <- g.matchMsg(local, id)
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ops)
+	}()
+	t := uint(0) // Total count, for progress reporting.
+	go g.listMessages(newMsgs, ops, nil, &t, done)
+	historyId, err := g.writeOps(ops, &t)
+	if err != nil {
+		g.drainOps(ops, done)
+		return err
+	}
+	if n := len(local.headers); n > 0 {
+		log.Println(n, "local messages couldn't be matched to a Gmail message.")
+	}
+	return g.cache.SetHistoryIdx(historyId)
+}
@@ -0,0 +1,287 @@
+package gmail
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/meelapshah/outtake/lib/maildir"
+)
+
+// retention is a policy limiting the messages kept locally.
+type retention struct {
+	// NewerThan is a date, e.g. 2006-01-02, or an age, e.g. 30d, 6w, 12m or
+	// 1y. Empty means no limit.
+	NewerThan string
+	// PerLabel is how many of the most recent messages of each label are
+	// kept. 0 means no limit.
+	PerLabel int
+}
+
+// cutoff returns the time before which messages aren't kept, or the zero
+// time if there is no such limit.
+func (r retention) cutoff(now time.Time) (time.Time, error) {
+	s := r.NewerThan
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := ParseDate(s); err == nil {
+		return t, nil
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return time.Time{}, fmt.Errorf("bad date or age %q", s)
+	}
+	switch s[len(s)-1] {
+	case 'd':
+		return now.AddDate(0, 0, -n), nil
+	case 'w':
+		return now.AddDate(0, 0, -7*n), nil
+	case 'm':
+		return now.AddDate(0, -n, 0), nil
+	case 'y':
+		return now.AddDate(-n, 0, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("bad date or age %q", s)
+}
+
+// widens reports whether r keeps messages that old didn't.
+func (r retention) widens(old retention, now time.Time) (bool, error) {
+	cut, err := r.cutoff(now)
+	if err != nil {
+		return false, err
+	}
+	oldCut, err := old.cutoff(now)
+	if err != nil {
+		return false, err
+	}
+	if !oldCut.IsZero() && (cut.IsZero() || cut.Before(oldCut)) {
+		return true, nil
+	}
+	return old.PerLabel > 0 && (r.PerLabel == 0 || r.PerLabel > old.PerLabel), nil
+}
+
+// updateRetention applies RetainNewerThan and RetainPerLabel. If they keep
+// messages that the policy of the last sync excluded, those are no longer
+// excluded, and it returns true: they are only found again by a full sync.
+func (g *Gmail) updateRetention() (bool, error) {
+	r := retention{NewerThan: RetainNewerThan, PerLabel: RetainPerLabel}
+	now := time.Now()
+	cut, err := r.cutoff(now)
+	if err != nil {
+		return false, err
+	}
+	g.retainSince = cut
+	old, err := g.cache.GetRetention()
+	if err != nil {
+		return false, err
+	}
+	if old == r {
+		return false, nil
+	}
+	widened, err := r.widens(old, now)
+	if err != nil {
+		return false, err
+	}
+	var ids []string
+	if widened {
+		ms := make(chan string)
+		if ids, err = collectItems(ms, g.cache.GetExcluded(ms)); err != nil {
+			return false, err
+		}
+	}
+	return len(ids) > 0, g.writeBatch(func(b *batch) error {
+		for _, id := range ids {
+			if err := b.cache.DelExcluded(id); err != nil {
+				return err
+			}
+		}
+		return b.cache.SetRetention(r)
+	})
+}
+
+// labelLimit is what a full sync needs to apply RetainPerLabel while it
+// lists messages, so that those past the limit aren't downloaded.
+type labelLimit struct {
+	// keep holds the most recent RetainPerLabel messages of each label.
+	keep map[string]struct{}
+	// labeled holds every message with a label.
+	labeled map[string]struct{}
+}
+
+// listLabelLimit lists the messages of each label, newest first as Gmail
+// lists them, or returns nil if RetainPerLabel is off.
+func (g *Gmail) listLabelLimit() (*labelLimit, error) {
+	if RetainPerLabel <= 0 {
+		return nil, nil
+	}
+	ls, err := g.svc.GetLabels()
+	if err != nil {
+		return nil, err
+	}
+	l := &labelLimit{keep: make(map[string]struct{}), labeled: make(map[string]struct{})}
+	for _, label := range ls.Labels {
+		n := 0
+		page := ""
+		for {
+			r, err := g.svc.GetMessages(label.Id, page)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range r.Messages {
+				if n < RetainPerLabel {
+					l.keep[m.Id] = struct{}{}
+				}
+				n++
+				l.labeled[m.Id] = struct{}{}
+			}
+			if page = r.NextPageToken; page == "" {
+				break
+			}
+		}
+	}
+	return l, nil
+}
+
+// filterLabelLimit passes the messages listed on ids to out, and excludes
+// those that aren't cached and are past RetainPerLabel in every one of their
+// labels. Unlabeled messages count as a label of their own, ranked in the
+// order they are listed. Cached messages are left to applyRetention.
+func (g *Gmail) filterLabelLimit(l *labelLimit, ids <-chan string, out chan<- string, ops chan<- msgOp) {
+	defer close(out)
+	unlabeled := 0
+	for id := range ids {
+		if _, ok := l.keep[id]; ok {
+			out <- id
+			continue
+		}
+		if _, ok := l.labeled[id]; !ok {
+			if unlabeled++; unlabeled <= RetainPerLabel {
+				out <- id
+				continue
+			}
+		}
+		if _, exists, err := g.cache.GetMsgKey(id); err != nil {
+			ops <- msgOp{Id: id, Error: err}
+		} else if exists {
+			out <- id
+		} else {
+			ops <- msgOp{Id: id, Operation: EXCLUDE}
+		}
+	}
+}
+
+// datedMsg is a cached message and the time it was received.
+type datedMsg struct {
+	id   string
+	date time.Time
+}
+
+// applyRetention removes the messages left out by the retention policy from
+// the maildir and the cache, not from Gmail, and records them as excluded.
+// Messages are dated by when Gmail received them. Those cached before the
+// date was recorded are dated by their files, which are dated likewise
+// unless something touched them since.
+func (g *Gmail) applyRetention() error {
+	if g.retainSince.IsZero() && RetainPerLabel <= 0 {
+		return nil
+	}
+	var mtimes map[maildir.Key]time.Time
+	is := make(chan string)
+	ids, err := collectItems(is, g.cache.GetMsgs(is))
+	if err != nil {
+		return err
+	}
+	drop := make(map[string]struct{})
+	byLabel := make(map[string][]datedMsg)
+	for _, id := range ids {
+		d, ok, err := g.cache.GetMsgDate(id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if mtimes == nil {
+				mtimes = make(map[maildir.Key]time.Time)
+				if err := g.dir.Walk(func(m maildir.Message) error {
+					mtimes[m.Key] = m.ModTime
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+			k, _, err := g.cache.GetMsgKey(id)
+			if err != nil {
+				return err
+			}
+			if d, ok = mtimes[k]; !ok {
+				// Missing; verify's business.
+				continue
+			}
+		}
+		if d.Before(g.retainSince) {
+			drop[id] = struct{}{}
+			continue
+		}
+		if RetainPerLabel > 0 {
+			labels, _, err := g.cache.GetMsgLabels(id)
+			if err != nil {
+				return err
+			}
+			if len(labels) == 0 {
+				// Unlabeled messages count as a label of their own.
+				labels = []string{""}
+			}
+			for _, l := range labels {
+				byLabel[l] = append(byLabel[l], datedMsg{id, d})
+			}
+		}
+	}
+	if RetainPerLabel > 0 {
+		// Messages are kept if they are recent enough in any of their labels.
+		keep := make(map[string]struct{})
+		for _, ms := range byLabel {
+			sort.Slice(ms, func(i, j int) bool { return ms[i].date.After(ms[j].date) })
+			for i, m := range ms {
+				if i < RetainPerLabel {
+					keep[m.id] = struct{}{}
+				} else {
+					drop[m.id] = struct{}{}
+				}
+			}
+		}
+		for id := range keep {
+			delete(drop, id)
+		}
+	}
+	var dels []string
+	for id := range drop {
+		dels = append(dels, id)
+	}
+	n := len(dels)
+	for len(dels) > 0 {
+		m := CacheBatchSize
+		if m > len(dels) {
+			m = len(dels)
+		}
+		if err := g.writeBatch(func(b *batch) error {
+			for _, id := range dels[:m] {
+				if err := g.writeDel(b, id); err != nil {
+					return err
+				}
+				if err := b.cache.SetExcluded(id); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		dels = dels[m:]
+	}
+	if n > 0 {
+		log.Println("Removed", n, "messages outside the retention policy")
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package gmail
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+)
+
+const (
+	// Cache namespace holding the schema version.
+	schemaNs = "schema"
+)
+
+// migrations[i] upgrades a cache from schema version i to i+1. Each migration
+// runs in its own transaction, together with the version bump.
+var migrations = []func(c *gmailCache) error{
+	// 0 -> 1: caches written before versioning was introduced already have the
+	// version 1 layout; they only lack the version record.
+	func(c *gmailCache) error { return nil },
+	// 1 -> 2: mid_to_gid maps each Message-Id to a gob-encoded list of Gmail
+	// IDs, rather than a single one. Rebuild it from gid_to_mid, which also
+	// recovers the Gmail IDs that were lost to duplicate Message-Ids.
+	func(c *gmailCache) error {
+		ms := make(chan string)
+		mIds, err := collectItems(ms, c.Cache.Items(midToGid, ms))
+		if err != nil {
+			return err
+		}
+		for _, mId := range mIds {
+			if err := c.Cache.Del(midToGid, mId); err != nil {
+				return err
+			}
+		}
+		gs := make(chan string)
+		gIds, err := collectItems(gs, c.Cache.Items(gidToMid, gs))
+		if err != nil {
+			return err
+		}
+		byMid := make(map[string][]string)
+		for _, gId := range gIds {
+			mId, _, err := c.GetMessageIdForGmailId(gId)
+			if err != nil {
+				return err
+			}
+			byMid[mId] = append(byMid[mId], gId)
+		}
+		for mId, gIds := range byMid {
+			if err := c.setGmailIdsForMessageId(mId, gIds); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2 -> 3: the messages table of sqlite caches gained the size, sha256 and
+	// thread_id columns. Bolt caches keep them in namespaces of their own, so
+	// they need nothing.
+	func(c *gmailCache) error {
+		if s, ok := c.Cache.(*sqliteCache); ok {
+			return s.addColumns("messages", [][2]string{{"size", "INTEGER"}, {"sha256", "TEXT"}, {"thread_id", "TEXT"}})
+		}
+		return nil
+	},
+	// 3 -> 4: messages record the date Gmail received them, in the
+	// internal_date column of sqlite caches.
+	func(c *gmailCache) error {
+		if s, ok := c.Cache.(*sqliteCache); ok {
+			return s.addColumns("messages", [][2]string{{"internal_date", "INTEGER"}})
+		}
+		return nil
+	},
+}
+
+// schemaVersion is the version of the cache layout written by this version of
+// outtake.
+var schemaVersion = uint64(len(migrations))
+
+func (c *gmailCache) GetSchemaVersion() (uint64, bool, error) {
+	b, ok, err := c.Cache.Get(schemaNs, "version")
+	if !ok || err != nil {
+		return 0, false, err
+	}
+	v, _ := binary.Uvarint(b)
+	return v, true, nil
+}
+
+func (c *gmailCache) SetSchemaVersion(v uint64) error {
+	b := make([]byte, binary.MaxVarintLen64)
+	binary.PutUvarint(b, v)
+	return c.Cache.Set(schemaNs, "version", b)
+}
+
+// isEmpty reports whether nothing has been written to the cache yet.
+func (c *gmailCache) isEmpty() (bool, error) {
+	if _, ok, err := c.Cache.Get(oauthToken, "0"); err != nil || ok {
+		return false, err
+	}
+	if _, ok, err := c.Cache.Get(historyIndex, "0"); err != nil || ok {
+		return false, err
+	}
+	ms := make(chan string)
+	ids, err := collectItems(ms, c.GetMsgs(ms))
+	return len(ids) == 0, err
+}
+
+// migrateCache upgrades the cache to schemaVersion, first saving a copy of it
+// next to backupPrefix. Caches written by a newer version of outtake are
+// refused, since we can't know how to read them.
+func migrateCache(c *gmailCache, backupPrefix string) error {
+	v, ok, err := c.GetSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if empty, err := c.isEmpty(); err != nil {
+			return err
+		} else if empty {
+			return c.SetSchemaVersion(schemaVersion)
+		}
+	}
+	if v > schemaVersion {
+		return fmt.Errorf("cache has schema version %d, but this version of outtake only supports up to %d; please upgrade outtake", v, schemaVersion)
+	} else if v == schemaVersion {
+		return nil
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", backupPrefix, v)
+	log.Printf("Upgrading cache from version %d to %d, saving a backup to %s", v, schemaVersion, backup)
+	if err := c.Cache.Backup(backup); err != nil {
+		return err
+	}
+	for ; v < schemaVersion; v++ {
+		m := migrations[v]
+		if err := c.Batch(func(tc *gmailCache) error {
+			if err := m(tc); err != nil {
+				return err
+			}
+			return tc.SetSchemaVersion(v + 1)
+		}); err != nil {
+			return fmt.Errorf("migrating cache to version %d: %v", v+1, err)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,11 @@
 package gmail
 
 import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/meelapshah/outtake/lib"
@@ -11,15 +16,33 @@ import (
 const (
 	maxQps     = 50
 	maxRetries = 8
+	// Where raw messages are streamed from.
+	messagesURL = "https://gmail.googleapis.com/gmail/v1/users/me/messages/"
 )
 
 // Wrapper for the Gmail REST interface. This abstraction helps with unit testing.
 type gmailService interface {
-	GetRawMessage(id string) (string, error)
+	// GetRawMessage streams the decoded RFC 2822 bytes of message id.
+	GetRawMessage(id string) (io.ReadCloser, error)
 	GetMetadata(id string) (*gmail.Message, error)
+	// GetFull returns message id with its payload parsed into parts, and
+	// GetAttachment the decoded body of one of its parts too large to be
+	// included.
+	GetFull(id string) (*gmail.Message, error)
+	GetAttachment(msgId, id string) ([]byte, error)
 	GetLabels() (*gmail.ListLabelsResponse, error)
 	GetHistory(historyIndex uint64, label, page string) (*gmail.ListHistoryResponse, error)
 	GetMessages(q, page string) (*gmail.ListMessagesResponse, error)
+	// GetThreads lists the threads with a message labeled labelId.
+	GetThreads(labelId, page string) (*gmail.ListThreadsResponse, error)
+	// GetThread returns thread id with the IDs of all its messages.
+	GetThread(id string) (*gmail.Thread, error)
+	// GetDrafts lists the drafts, with the IDs of their current messages.
+	GetDrafts(page string) (*gmail.ListDraftsResponse, error)
+	// CreateDraft uploads the RFC 2822 message raw as a new draft, and
+	// UpdateDraft replaces draft id with it.
+	CreateDraft(raw []byte) (*gmail.Draft, error)
+	UpdateDraft(id string, raw []byte) (*gmail.Draft, error)
 	ModifyLabels(msgIds []string, addLabels []string, delLabels []string) error
 }
 
@@ -29,12 +52,13 @@ type backoff struct {
 
 type restGmailService struct {
 	gmailService
+	client  *http.Client
 	svc     *gmail.UsersService
 	limiter lib.RateLimit
 }
 
-func newRestGmailService(svc *gmail.UsersService) *restGmailService {
-	r := &restGmailService{svc: svc,
+func newRestGmailService(client *http.Client, svc *gmail.UsersService) *restGmailService {
+	r := &restGmailService{client: client, svc: svc,
 		limiter: lib.RateLimit{Period: time.Second,
 			Rate:         maxQps,
 			BackoffLimit: maxRetries,
@@ -48,17 +72,92 @@ func isRateLimited(err error) (error, bool) {
 	return err, !(ok && e.Code == 429)
 }
 
-func (s *restGmailService) GetRawMessage(id string) (string, error) {
-	var r *gmail.Message
+// rawFieldReader reads the value of the "raw" field of a message resource as
+// it arrives, rather than decoding the whole JSON response. Base64url values
+// never need JSON unescaping.
+type rawFieldReader struct {
+	r       *bufio.Reader
+	started bool
+	done    bool
+	pending []byte
+}
+
+// skipTo discards everything up to and including the next c.
+func (f *rawFieldReader) skipTo(c byte) error {
+	for {
+		_, err := f.r.ReadSlice(c)
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// start skips to the beginning of the raw field's value.
+func (f *rawFieldReader) start() error {
+	for {
+		if err := f.skipTo('"'); err != nil {
+			return err
+		}
+		name, err := f.r.ReadString('"')
+		if err != nil {
+			return err
+		}
+		if name == `raw"` {
+			return f.skipTo('"')
+		}
+	}
+}
+
+func (f *rawFieldReader) Read(p []byte) (int, error) {
+	if !f.started {
+		f.started = true
+		if err := f.start(); err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if len(f.pending) == 0 {
+		if f.done {
+			return 0, io.EOF
+		}
+		v, err := f.r.ReadSlice('"')
+		if err == nil {
+			v, f.done = v[:len(v)-1], true
+		} else if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != bufio.ErrBufferFull {
+			return 0, err
+		}
+		f.pending = v
+	}
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	return n, nil
+}
+
+func (s *restGmailService) GetRawMessage(id string) (io.ReadCloser, error) {
+	u := messagesURL + url.PathEscape(id) + "?format=raw&fields=raw&alt=json"
+	var res *http.Response
 	var err error
 	err = s.limiter.DoWithBackoff(func() (error, bool) {
-		r, err = s.svc.Messages.Get("me", id).Format("raw").Do()
+		res, err = s.client.Get(u)
+		if err != nil {
+			return isRateLimited(err)
+		}
+		if err = googleapi.CheckResponse(res); err != nil {
+			res.Body.Close()
+		}
 		return isRateLimited(err)
 	})
-	if r != nil {
-		return r.Raw, err
+	if err != nil {
+		return nil, err
 	}
-	return "", err
+	dec := base64.NewDecoder(base64.URLEncoding, &rawFieldReader{r: bufio.NewReader(res.Body)})
+	return struct {
+		io.Reader
+		io.Closer
+	}{dec, res.Body}, nil
 }
 
 func (s *restGmailService) GetMetadata(id string) (*gmail.Message, error) {
@@ -71,6 +170,29 @@ func (s *restGmailService) GetMetadata(id string) (*gmail.Message, error) {
 	return m, err
 }
 
+func (s *restGmailService) GetFull(id string) (*gmail.Message, error) {
+	var m *gmail.Message
+	var err error
+	err = s.limiter.DoWithBackoff(func() (error, bool) {
+		m, err = s.svc.Messages.Get("me", id).Format("full").Do()
+		return isRateLimited(err)
+	})
+	return m, err
+}
+
+func (s *restGmailService) GetAttachment(msgId, id string) ([]byte, error) {
+	var b *gmail.MessagePartBody
+	var err error
+	err = s.limiter.DoWithBackoff(func() (error, bool) {
+		b, err = s.svc.Messages.Attachments.Get("me", msgId, id).Do()
+		return isRateLimited(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodeBodyData(b.Data)
+}
+
 func (s *restGmailService) GetLabels() (*gmail.ListLabelsResponse, error) {
 	var r *gmail.ListLabelsResponse
 	var err error
@@ -110,6 +232,62 @@ func (s *restGmailService) GetMessages(labelId, page string) (*gmail.ListMessage
 	return r, err
 }
 
+func (s *restGmailService) GetThreads(labelId, page string) (*gmail.ListThreadsResponse, error) {
+	threads := s.svc.Threads.List("me").Q("-in:chats")
+	if labelId != "" {
+		threads.LabelIds(labelId)
+	}
+	var r *gmail.ListThreadsResponse
+	var err error
+	err = s.limiter.DoWithBackoff(func() (error, bool) {
+		r, err = threads.PageToken(page).Do()
+		return isRateLimited(err)
+	})
+	return r, err
+}
+
+func (s *restGmailService) GetThread(id string) (*gmail.Thread, error) {
+	var t *gmail.Thread
+	var err error
+	err = s.limiter.DoWithBackoff(func() (error, bool) {
+		t, err = s.svc.Threads.Get("me", id).Format("minimal").Do()
+		return isRateLimited(err)
+	})
+	return t, err
+}
+
+func (s *restGmailService) GetDrafts(page string) (*gmail.ListDraftsResponse, error) {
+	var r *gmail.ListDraftsResponse
+	var err error
+	err = s.limiter.DoWithBackoff(func() (error, bool) {
+		r, err = s.svc.Drafts.List("me").PageToken(page).Do()
+		return isRateLimited(err)
+	})
+	return r, err
+}
+
+func (s *restGmailService) CreateDraft(raw []byte) (*gmail.Draft, error) {
+	d := &gmail.Draft{Message: &gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw)}}
+	var r *gmail.Draft
+	var err error
+	err = s.limiter.DoWithBackoff(func() (error, bool) {
+		r, err = s.svc.Drafts.Create("me", d).Do()
+		return isRateLimited(err)
+	})
+	return r, err
+}
+
+func (s *restGmailService) UpdateDraft(id string, raw []byte) (*gmail.Draft, error) {
+	d := &gmail.Draft{Id: id, Message: &gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw)}}
+	var r *gmail.Draft
+	var err error
+	err = s.limiter.DoWithBackoff(func() (error, bool) {
+		r, err = s.svc.Drafts.Update("me", id, d).Do()
+		return isRateLimited(err)
+	})
+	return r, err
+}
+
 func (s *restGmailService) ModifyLabels(msgIds []string, addLabels []string, removeLabels []string) error {
 	var err error
 	err = s.limiter.DoWithBackoff(func() (error, bool) {
@@ -0,0 +1,457 @@
+package gmail
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meelapshah/outtake/lib"
+	"golang.org/x/oauth2"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema lays the cache out in ordinary tables, so that sync state can
+// be inspected with SQL. Namespaces without a table of their own are kept in
+// kv.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	gmail_id    TEXT PRIMARY KEY,
+	maildir_key TEXT,
+	message_id  TEXT,
+	labels      TEXT, -- JSON array of the labels in the local copy.
+	size        INTEGER, -- Gmail's size estimate.
+	sha256      TEXT, -- Hex SHA-256 of the maildir file.
+	thread_id   TEXT,
+	internal_date INTEGER -- Milliseconds since the epoch.
+);
+CREATE INDEX IF NOT EXISTS messages_message_id ON messages (message_id);
+CREATE TABLE IF NOT EXISTS message_ids (
+	message_id TEXT NOT NULL,
+	gmail_id   TEXT NOT NULL,
+	PRIMARY KEY (message_id, gmail_id)
+);
+CREATE TABLE IF NOT EXISTS gmail_labels (
+	label    TEXT NOT NULL,
+	gmail_id TEXT NOT NULL,
+	PRIMARY KEY (label, gmail_id)
+);
+CREATE TABLE IF NOT EXISTS history (
+	id         INTEGER PRIMARY KEY CHECK (id = 0),
+	history_id INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tokens (
+	id            INTEGER PRIMARY KEY CHECK (id = 0),
+	access_token  TEXT,
+	token_type    TEXT,
+	refresh_token TEXT,
+	expiry        TEXT,
+	scopes        TEXT -- JSON array.
+);
+CREATE TABLE IF NOT EXISTS kv (
+	ns    TEXT NOT NULL,
+	key   TEXT NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (ns, key)
+);
+`
+
+// Columns of the messages table backing each namespace.
+var messageColumns = map[string]string{
+	midToKey:    "maildir_key",
+	gidToMid:    "message_id",
+	midToLabels: "labels",
+	midToSize:   "size",
+	midToSha256: "sha256",
+	midToThread: "thread_id",
+	midToDate:   "internal_date",
+}
+
+// addColumns adds the columns missing from a table created by an older
+// version, given with their types. Migrations use it to upgrade the tables.
+func (c *sqliteCache) addColumns(table string, cols [][2]string) error {
+	rows, err := c.q.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, col := range cols {
+		if !have[col[0]] {
+			if _, err := c.q.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + col[0] + ` ` + col[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sqlQuerier is the part of *sql.DB and *sql.Tx used by sqliteCache.
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqliteCache is a lib.Cache stored in a SQLite database. It understands the
+// layout of the Gmail namespaces, and translates their encoded values to and
+// from table rows.
+type sqliteCache struct {
+	db *sql.DB
+	q  sqlQuerier
+	// inTx is set for the Cache passed to Batch.
+	inTx bool
+}
+
+func newSQLiteCache(path string) (*sqliteCache, error) {
+	// WAL lets readers proceed while a batch is being written. Batches take
+	// the write lock up front, so that two of them can't both start reading
+	// and then fail with SQLITE_BUSY when one upgrades to writing, which the
+	// busy timeout doesn't help with. Opening the cache writes too, to set
+	// up the schema, so while a sync is running even cache dump and verify
+	// wait up to SQLiteBusyTimeout for its batch of CacheBatchSize operations
+	// to commit, and fail with SQLITE_BUSY after that.
+	timeout := SQLiteBusyTimeout.Milliseconds()
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=journal_mode(WAL)&_pragma=busy_timeout(%d)&_txlock=immediate", path, timeout))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteCache{db: db, q: db}, nil
+}
+
+func (c *sqliteCache) Set(ns, k string, v []byte) error {
+	if col, ok := messageColumns[ns]; ok {
+		var val interface{} = string(v)
+		switch ns {
+		case midToLabels:
+			ls, err := decodeStrings(v)
+			if err != nil {
+				return err
+			}
+			if val, err = jsonStrings(ls); err != nil {
+				return err
+			}
+		case midToSize, midToDate:
+			n, _ := binary.Uvarint(v)
+			val = int64(n)
+		}
+		_, err := c.q.Exec(`INSERT INTO messages (gmail_id, `+col+`) VALUES (?, ?)
+			ON CONFLICT (gmail_id) DO UPDATE SET `+col+` = excluded.`+col, k, val)
+		return err
+	}
+	switch {
+	case ns == midToGid:
+		gIds, err := decodeStrings(v)
+		if err != nil {
+			return err
+		}
+		if _, err := c.q.Exec(`DELETE FROM message_ids WHERE message_id = ?`, k); err != nil {
+			return err
+		}
+		for _, gId := range gIds {
+			if _, err := c.q.Exec(`INSERT OR IGNORE INTO message_ids (message_id, gmail_id) VALUES (?, ?)`, k, gId); err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasPrefix(ns, labelToGidPrefix):
+		_, err := c.q.Exec(`INSERT OR IGNORE INTO gmail_labels (label, gmail_id) VALUES (?, ?)`,
+			strings.TrimPrefix(ns, labelToGidPrefix), k)
+		return err
+	case ns == historyIndex && k == "0":
+		h, _ := binary.Uvarint(v)
+		_, err := c.q.Exec(`INSERT INTO history (id, history_id) VALUES (0, ?)
+			ON CONFLICT (id) DO UPDATE SET history_id = excluded.history_id`, int64(h))
+		return err
+	case ns == oauthToken && k == "0":
+		var tok oauth2.Token
+		if err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&tok); err != nil {
+			return err
+		}
+		_, err := c.q.Exec(`INSERT INTO tokens (id, access_token, token_type, refresh_token, expiry) VALUES (0, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET access_token = excluded.access_token, token_type = excluded.token_type,
+				refresh_token = excluded.refresh_token, expiry = excluded.expiry`,
+			tok.AccessToken, tok.TokenType, tok.RefreshToken, tok.Expiry.Format(time.RFC3339Nano))
+		return err
+	case ns == oauthScopes && k == "0":
+		ss, err := decodeStrings(v)
+		if err != nil {
+			return err
+		}
+		js, err := jsonStrings(ss)
+		if err != nil {
+			return err
+		}
+		_, err = c.q.Exec(`INSERT INTO tokens (id, scopes) VALUES (0, ?)
+			ON CONFLICT (id) DO UPDATE SET scopes = excluded.scopes`, js)
+		return err
+	}
+	_, err := c.q.Exec(`INSERT INTO kv (ns, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (ns, key) DO UPDATE SET value = excluded.value`, ns, k, v)
+	return err
+}
+
+func (c *sqliteCache) Get(ns, k string) ([]byte, bool, error) {
+	if col, ok := messageColumns[ns]; ok {
+		var v sql.NullString
+		err := c.q.QueryRow(`SELECT `+col+` FROM messages WHERE gmail_id = ?`, k).Scan(&v)
+		if err == sql.ErrNoRows || (err == nil && !v.Valid) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		switch ns {
+		case midToSize, midToDate:
+			n, err := strconv.ParseInt(v.String, 10, 64)
+			if err != nil {
+				return nil, false, err
+			}
+			b := make([]byte, binary.MaxVarintLen64)
+			binary.PutUvarint(b, uint64(n))
+			return b, true, nil
+		case midToLabels:
+			var ls []string
+			if err := json.Unmarshal([]byte(v.String), &ls); err != nil {
+				return nil, false, err
+			}
+			bs, err := encodeStrings(ls)
+			return bs, err == nil, err
+		default:
+			return []byte(v.String), true, nil
+		}
+	}
+	switch {
+	case ns == midToGid:
+		gIds, err := c.column(`SELECT gmail_id FROM message_ids WHERE message_id = ? ORDER BY rowid`, k)
+		if len(gIds) == 0 || err != nil {
+			return nil, false, err
+		}
+		bs, err := encodeStrings(gIds)
+		return bs, err == nil, err
+	case strings.HasPrefix(ns, labelToGidPrefix):
+		var n int
+		err := c.q.QueryRow(`SELECT COUNT(*) FROM gmail_labels WHERE label = ? AND gmail_id = ?`,
+			strings.TrimPrefix(ns, labelToGidPrefix), k).Scan(&n)
+		return []byte{}, n > 0, err
+	case ns == historyIndex && k == "0":
+		var h int64
+		err := c.q.QueryRow(`SELECT history_id FROM history WHERE id = 0`).Scan(&h)
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		b := make([]byte, binary.MaxVarintLen64)
+		binary.PutUvarint(b, uint64(h))
+		return b, true, nil
+	case ns == oauthToken && k == "0":
+		var at, tt, rt, exp sql.NullString
+		err := c.q.QueryRow(`SELECT access_token, token_type, refresh_token, expiry FROM tokens WHERE id = 0`).Scan(&at, &tt, &rt, &exp)
+		if err == sql.ErrNoRows || (err == nil && !at.Valid) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		tok := oauth2.Token{AccessToken: at.String, TokenType: tt.String, RefreshToken: rt.String}
+		if exp.String != "" {
+			if tok.Expiry, err = time.Parse(time.RFC3339Nano, exp.String); err != nil {
+				return nil, false, err
+			}
+		}
+		bs := new(bytes.Buffer)
+		if err := gob.NewEncoder(bs).Encode(&tok); err != nil {
+			return nil, false, err
+		}
+		return bs.Bytes(), true, nil
+	case ns == oauthScopes && k == "0":
+		var js sql.NullString
+		err := c.q.QueryRow(`SELECT scopes FROM tokens WHERE id = 0`).Scan(&js)
+		if err == sql.ErrNoRows || (err == nil && !js.Valid) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		var ss []string
+		if err := json.Unmarshal([]byte(js.String), &ss); err != nil {
+			return nil, false, err
+		}
+		bs, err := encodeStrings(ss)
+		return bs, err == nil, err
+	}
+	var v []byte
+	err := c.q.QueryRow(`SELECT value FROM kv WHERE ns = ? AND key = ?`, ns, k).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	return v, err == nil, err
+}
+
+func (c *sqliteCache) Del(ns, k string) error {
+	if col, ok := messageColumns[ns]; ok {
+		if _, err := c.q.Exec(`UPDATE messages SET `+col+` = NULL WHERE gmail_id = ?`, k); err != nil {
+			return err
+		}
+		_, err := c.q.Exec(`DELETE FROM messages WHERE gmail_id = ?
+			AND maildir_key IS NULL AND message_id IS NULL AND labels IS NULL
+			AND size IS NULL AND sha256 IS NULL AND thread_id IS NULL AND internal_date IS NULL`, k)
+		return err
+	}
+	var err error
+	switch {
+	case ns == midToGid:
+		_, err = c.q.Exec(`DELETE FROM message_ids WHERE message_id = ?`, k)
+	case strings.HasPrefix(ns, labelToGidPrefix):
+		_, err = c.q.Exec(`DELETE FROM gmail_labels WHERE label = ? AND gmail_id = ?`,
+			strings.TrimPrefix(ns, labelToGidPrefix), k)
+	case ns == historyIndex && k == "0":
+		_, err = c.q.Exec(`DELETE FROM history`)
+	case ns == oauthToken && k == "0":
+		_, err = c.q.Exec(`UPDATE tokens SET access_token = NULL, token_type = NULL, refresh_token = NULL, expiry = NULL`)
+	case ns == oauthScopes && k == "0":
+		_, err = c.q.Exec(`UPDATE tokens SET scopes = NULL`)
+	default:
+		_, err = c.q.Exec(`DELETE FROM kv WHERE ns = ? AND key = ?`, ns, k)
+	}
+	return err
+}
+
+// column returns the single column selected by query.
+func (c *sqliteCache) column(query string, args ...interface{}) ([]string, error) {
+	rows, err := c.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var vs []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, rows.Err()
+}
+
+func (c *sqliteCache) keys(ns string) ([]string, error) {
+	if col, ok := messageColumns[ns]; ok {
+		return c.column(`SELECT gmail_id FROM messages WHERE ` + col + ` IS NOT NULL`)
+	}
+	switch {
+	case ns == midToGid:
+		return c.column(`SELECT DISTINCT message_id FROM message_ids`)
+	case strings.HasPrefix(ns, labelToGidPrefix):
+		return c.column(`SELECT gmail_id FROM gmail_labels WHERE label = ?`, strings.TrimPrefix(ns, labelToGidPrefix))
+	case ns == historyIndex:
+		return c.column(`SELECT '0' FROM history`)
+	case ns == oauthToken:
+		return c.column(`SELECT '0' FROM tokens WHERE access_token IS NOT NULL`)
+	case ns == oauthScopes:
+		return c.column(`SELECT '0' FROM tokens WHERE scopes IS NOT NULL`)
+	}
+	return c.column(`SELECT key FROM kv WHERE ns = ?`, ns)
+}
+
+func (c *sqliteCache) Items(ns string, ks chan<- string) <-chan error {
+	errs := make(chan error, 1)
+	// As with bolt, read the keys up front so that consumers can write to the
+	// cache while iterating, and so a transaction isn't used concurrently.
+	keys, err := c.keys(ns)
+	go func() {
+		defer close(errs)
+		defer close(ks)
+		if err != nil {
+			errs <- err
+			return
+		}
+		for _, k := range keys {
+			ks <- k
+		}
+	}()
+	return errs
+}
+
+func (c *sqliteCache) Namespaces() ([]string, error) {
+	tabled := []string{midToGid, historyIndex, oauthToken, oauthScopes}
+	for ns := range messageColumns {
+		tabled = append(tabled, ns)
+	}
+	sort.Strings(tabled)
+	var nss []string
+	for _, ns := range tabled {
+		if ks, err := c.keys(ns); err != nil {
+			return nil, err
+		} else if len(ks) > 0 {
+			nss = append(nss, ns)
+		}
+	}
+	ls, err := c.column(`SELECT DISTINCT label FROM gmail_labels`)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range ls {
+		nss = append(nss, labelToGidPrefix+l)
+	}
+	others, err := c.column(`SELECT DISTINCT ns FROM kv`)
+	return append(nss, others...), err
+}
+
+func (c *sqliteCache) Batch(f func(lib.Cache) error) error {
+	if c.inTx {
+		return f(c)
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(&sqliteCache{db: c.db, q: tx, inTx: true}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c *sqliteCache) Backup(path string) error {
+	if c.inTx {
+		return errors.New("can't back up a sqlite cache from within a batch")
+	}
+	_, err := c.db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+func (c *sqliteCache) Close() error {
+	if c.inTx {
+		return nil
+	}
+	return c.db.Close()
+}
+
+func jsonStrings(ss []string) (string, error) {
+	if ss == nil {
+		ss = []string{}
+	}
+	bs, err := json.Marshal(ss)
+	return string(bs), err
+}
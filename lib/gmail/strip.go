@@ -0,0 +1,262 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// Header of the placeholder parts standing in for stripped attachments, with
+// the ID of the part in Gmail's payload.
+const strippedPartHeader = "X-Outtake-Stripped-Part"
+
+// decodeBodyData decodes the data of a message part body, which Gmail encodes
+// as base64url, with or without padding.
+func decodeBodyData(s string) ([]byte, error) {
+	if bs, err := base64.URLEncoding.DecodeString(s); err == nil {
+		return bs, nil
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// partHeader returns the value of header name of part p.
+func partHeader(p *gmail.MessagePart, name string) string {
+	for _, h := range p.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// buildMessage returns a reader of message m, fetched with GetFull, rebuilt as
+// MIME as it is read, so that only one part is held in memory at a time. Only
+// the bodies of the parts download selects are fetched: the others are
+// replaced by a short text part saying how to fetch them later. Bodies are
+// encoded afresh, so signatures over them won't verify. Fetch errors are
+// returned by Read, and closing the reader early stops the fetching.
+func (g *Gmail) buildMessage(m *gmail.Message, download func(partId string) bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		err := g.writePart(w, m.Id, m.Payload, download)
+		if err == nil {
+			err = w.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// writePart writes part p of message msgId, and the parts it contains.
+func (g *Gmail) writePart(w *bufio.Writer, msgId string, p *gmail.MessagePart, download func(string) bool) error {
+	if p.Body != nil && p.Body.AttachmentId != "" && len(p.Parts) == 0 && !download(p.PartId) {
+		writePlaceholder(w, msgId, p)
+		return nil
+	}
+	for _, h := range p.Headers {
+		fmt.Fprintf(w, "%s: %s\r\n", h.Name, h.Value)
+	}
+	w.WriteString("\r\n")
+	if len(p.Parts) > 0 {
+		_, params, _ := mime.ParseMediaType(partHeader(p, "Content-Type"))
+		boundary := params["boundary"]
+		if boundary == "" {
+			// A message/rfc822 part, holding a single message.
+			for _, c := range p.Parts {
+				if err := g.writePart(w, msgId, c, download); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for _, c := range p.Parts {
+			w.WriteString("--" + boundary + "\r\n")
+			if err := g.writePart(w, msgId, c, download); err != nil {
+				return err
+			}
+			w.WriteString("\r\n")
+		}
+		w.WriteString("--" + boundary + "--\r\n")
+		return nil
+	}
+	var data []byte
+	var err error
+	if p.Body == nil {
+		return nil
+	} else if p.Body.AttachmentId != "" {
+		data, err = g.svc.GetAttachment(msgId, p.Body.AttachmentId)
+	} else {
+		data, err = decodeBodyData(p.Body.Data)
+	}
+	if err != nil {
+		return err
+	}
+	return writeBody(w, strings.ToLower(strings.TrimSpace(partHeader(p, "Content-Transfer-Encoding"))), data)
+}
+
+// writeBody writes the decoded body data with the given transfer encoding.
+func writeBody(w *bufio.Writer, encoding string, data []byte) error {
+	switch encoding {
+	case "base64":
+		s := base64.StdEncoding.EncodeToString(data)
+		for len(s) > 76 {
+			w.WriteString(s[:76] + "\r\n")
+			s = s[76:]
+		}
+		if s != "" {
+			w.WriteString(s + "\r\n")
+		}
+	case "quoted-printable":
+		qw := quotedprintable.NewWriter(w)
+		if _, err := qw.Write(data); err != nil {
+			return err
+		}
+		if err := qw.Close(); err != nil {
+			return err
+		}
+	default:
+		w.Write(data)
+	}
+	return nil
+}
+
+// writePlaceholder writes the part standing in for attachment p. The headers
+// of p other than the Content-* ones are kept: when the message is a single
+// part, p is the whole message, and they are its From, Subject and so on.
+func writePlaceholder(w *bufio.Writer, msgId string, p *gmail.MessagePart) {
+	name := p.Filename
+	if name == "" {
+		name = "part " + p.PartId
+	}
+	for _, h := range p.Headers {
+		if !strings.HasPrefix(strings.ToLower(h.Name), "content-") {
+			fmt.Fprintf(w, "%s: %s\r\n", h.Name, h.Value)
+		}
+	}
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(w, "Content-Disposition: inline\r\n")
+	fmt.Fprintf(w, "%s: %s\r\n\r\n", strippedPartHeader, p.PartId)
+	fmt.Fprintf(w, "[%q (%s, %d bytes) was not downloaded. Run\r\n", name, p.MimeType, p.Body.Size)
+	fmt.Fprintf(w, "outtake fetch-attachment %s to fetch it.]\r\n", strings.TrimSpace(msgId+" "+p.PartId))
+}
+
+// getStripped is getBody for messages larger than MaxMessageSize: it rebuilds
+// the message without its attachments.
+func (g *Gmail) getStripped(o *msgOp) (io.ReadCloser, error) {
+	m, err := g.svc.GetFull(o.Id)
+	if err != nil {
+		return nil, err
+	}
+	return g.buildMessage(m, func(string) bool { return false }), nil
+}
+
+// strippedParts returns the IDs of the parts whose placeholders are in the
+// maildir file fn. Only part headers are looked at, so a message quoting a
+// placeholder doesn't count.
+func (g *Gmail) strippedParts(fn string) (map[string]bool, error) {
+	f, err := g.dir.OpenFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	parts := make(map[string]bool)
+	boundaries := make(map[string]bool)
+	br := bufio.NewReader(f)
+	header := true // Whether a part header comes next.
+	for {
+		if header {
+			hb, err := readHeaderBlock(br)
+			if err != nil {
+				return nil, err
+			}
+			h, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(hb))).ReadMIMEHeader()
+			// The whole message's part ID is empty.
+			if ids, ok := h[textproto.CanonicalMIMEHeaderKey(strippedPartHeader)]; ok && len(ids) > 0 {
+				parts[strings.TrimSpace(ids[0])] = true
+			}
+			if _, params, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil && params["boundary"] != "" {
+				boundaries[params["boundary"]] = true
+			}
+			header = false
+		}
+		line, err := br.ReadString('\n')
+		if l := strings.TrimRight(line, " \t\r\n"); strings.HasPrefix(l, "--") && boundaries[l[2:]] {
+			header = true
+		}
+		if err == io.EOF {
+			return parts, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// FetchAttachments downloads attachments of message id that were stripped
+// because the message was larger than MaxMessageSize: those with the given
+// part IDs, or all of them. The message's file is replaced by one with the
+// attachments in place of their placeholders. It returns the number of
+// attachments fetched.
+func (g *Gmail) FetchAttachments(id string, parts []string) (int, error) {
+	k, ok, err := g.cache.GetMsgKey(id)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, fmt.Errorf("no message %v in the cache", id)
+	}
+	fn, err := g.dir.GetFile(k)
+	if err != nil {
+		return 0, err
+	}
+	date, err := msgDate(&g.cache, id, fn)
+	if err != nil {
+		return 0, err
+	}
+	d, err := g.dir.ForRewrite(fn)
+	if err != nil {
+		return 0, err
+	}
+	stripped, err := g.strippedParts(fn)
+	if err != nil {
+		return 0, err
+	}
+	fetch := make(map[string]bool)
+	for _, p := range parts {
+		if !stripped[p] {
+			return 0, fmt.Errorf("part %v of message %v wasn't stripped", p, id)
+		}
+		fetch[p] = true
+	}
+	if len(parts) == 0 {
+		fetch = stripped
+	}
+	if len(fetch) == 0 {
+		return 0, nil
+	}
+	m, err := g.svc.GetFull(id)
+	if err != nil {
+		return 0, err
+	}
+	body := g.buildMessage(m, func(p string) bool { return !stripped[p] || fetch[p] })
+	defer body.Close()
+	labels, _, err := g.cache.GetMsgLabels(id)
+	if err != nil {
+		return 0, err
+	}
+	o := msgOp{Id: id, ThreadId: m.ThreadId, InternalDate: m.InternalDate, Labels: labels}
+	kn, msg, sum, err := g.deliverStream(d, body, labels, g.headerEdits(&o), date)
+	if err != nil {
+		return 0, err
+	}
+	return len(fetch), g.writeBatch(func(b *batch) error {
+		return g.replaceMsg(b, id, k, kn, msg, sum)
+	})
+}
@@ -0,0 +1,257 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/meelapshah/outtake/lib"
+)
+
+var mboxFrom = []byte("From ")
+
+// mboxReader splits an mbox into messages, undoing mboxrd quoting of "From "
+// lines.
+type mboxReader struct {
+	r *bufio.Reader
+	// The "From " line starting the next message, if any.
+	from string
+}
+
+func newMboxReader(r io.Reader) (*mboxReader, error) {
+	m := &mboxReader{r: bufio.NewReader(r)}
+	line, err := m.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return m, nil
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	} else if !strings.HasPrefix(line, string(mboxFrom)) {
+		return nil, fmt.Errorf("not an mbox")
+	}
+	m.from = line
+	return m, nil
+}
+
+// Next returns the "From " line of the next message, and a reader of the
+// message that ends before the following one. The message must be read to
+// the end before calling Next again.
+func (m *mboxReader) Next() (string, io.Reader, bool) {
+	if m.from == "" {
+		return "", nil, false
+	}
+	from := strings.TrimRight(m.from, "\r\n")
+	m.from = ""
+	return from, &mboxMsg{m: m, bol: true}, true
+}
+
+// mboxMsg reads a single message of an mbox.
+type mboxMsg struct {
+	m   *mboxReader
+	buf []byte // Read but not yet returned.
+	// A blank line held back, as the one before a "From " line separates
+	// messages rather than belonging to the first.
+	blank []byte
+	bol   bool // Whether the next read starts a line.
+	eof   bool
+}
+
+func (r *mboxMsg) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 && !r.eof {
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	if len(r.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill reads the next line, or part of a line, of the message into buf.
+func (r *mboxMsg) fill() error {
+	line, err := r.m.r.ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	bol := r.bol
+	r.bol = err == nil
+	if bol && bytes.HasPrefix(line, mboxFrom) && err == nil {
+		// The start of the next message.
+		r.m.from = string(line)
+		r.eof = true
+		return nil
+	}
+	if bol && len(bytes.TrimLeft(line, ">")) < len(line) && bytes.HasPrefix(bytes.TrimLeft(line, ">"), mboxFrom) {
+		line = line[1:]
+	}
+	if r.blank != nil {
+		r.buf = append(r.buf, r.blank...)
+		r.blank = nil
+	}
+	if bol && err == nil && len(bytes.TrimRight(line, "\r\n")) == 0 {
+		r.blank = append([]byte{}, line...)
+	} else {
+		r.buf = append(r.buf, line...)
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parseTakeoutFrom returns the Gmail ID and date in the "From " line of a
+// Takeout mbox, e.g. "From 1593102384727000000@xxx Thu Jun 25 16:26:24 +0000
+// 2020".
+func parseTakeoutFrom(line string) (string, time.Time) {
+	fs := strings.SplitN(strings.TrimPrefix(line, string(mboxFrom)), " ", 2)
+	id := ""
+	if n, err := strconv.ParseUint(strings.SplitN(fs[0], "@", 2)[0], 10, 64); err == nil {
+		id = strconv.FormatUint(n, 16)
+	}
+	var t time.Time
+	if len(fs) == 2 {
+		for _, layout := range []string{"Mon Jan _2 15:04:05 -0700 2006", time.ANSIC} {
+			var err error
+			if t, err = time.Parse(layout, strings.TrimSpace(fs[1])); err == nil {
+				break
+			}
+		}
+	}
+	return id, t
+}
+
+// takeoutLabels maps the label names of an X-Gmail-Labels header to label
+// IDs. Takeout names system labels as Gmail's web interface does, e.g.
+// "Inbox" or "Category Promotions"; other labels are found in byName.
+// Takeout-only labels such as "Opened" and "Archived" are dropped.
+func takeoutLabels(v string, byName map[string]string) []string {
+	r := csv.NewReader(strings.NewReader(v))
+	r.TrimLeadingSpace = true
+	names, err := r.Read()
+	if err != nil {
+		names = strings.Split(v, ",")
+	}
+	var ids []string
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		if id, ok := byName[n]; ok {
+			ids = append(ids, id)
+		} else if strings.HasPrefix(n, "Category ") {
+			ids = append(ids, "CATEGORY_"+strings.ToUpper(strings.TrimPrefix(n, "Category ")))
+		} else if id := strings.ToUpper(n); lib.Contains(takeoutSystemLabels, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+var takeoutSystemLabels = []string{"INBOX", "UNREAD", "SENT", "STARRED", "IMPORTANT", "SPAM", "TRASH", "DRAFT", "CHAT"}
+
+// ImportTakeout seeds the maildir with the messages of a Google Takeout mbox
+// read from r, of size bytes, then rebuilds the cache from the maildir as
+// RebuildCache does. That only fetches the metadata of each message, and
+// sets the history index so that the next sync is incremental. Messages
+// already in the cache, or in the maildir with their X-GM-MSGID, are skipped.
+func (g *Gmail) ImportTakeout(r io.Reader, size int64, progress chan<- lib.Progress) error {
+	cr := &countingReader{r: r}
+	mbox, err := newMboxReader(cr)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]string)
+	ls, err := g.svc.GetLabels()
+	if err != nil {
+		return err
+	}
+	for _, l := range ls.Labels {
+		byName[l.Name] = l.Id
+	}
+	local, err := g.scanMaildir()
+	if err != nil {
+		return err
+	}
+	log.Println("Importing mbox.")
+	n := 0
+	for {
+		from, m, ok := mbox.Next()
+		if !ok {
+			break
+		}
+		if ok, err := g.importMsg(from, m, byName, local); err != nil {
+			return err
+		} else if ok {
+			n++
+		}
+		// Skip whatever wasn't read.
+		if _, err := io.Copy(ioutil.Discard, m); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress <- lib.Progress{Current: uint(cr.n), Total: uint(size)}
+		}
+	}
+	log.Println("Imported", n, "messages.")
+	return g.RebuildCache(progress)
+}
+
+// importMsg delivers the message read from r, whose mbox "From " line is
+// from, unless it's already in the cache or among the local messages.
+func (g *Gmail) importMsg(from string, r io.Reader, byName map[string]string, local *localMessages) (bool, error) {
+	id, date := parseTakeoutFrom(from)
+	if id != "" {
+		if _, ok := local.byGmailId[id]; ok {
+			return false, nil
+		}
+		if _, ok, err := g.cache.GetMsgKey(id); err != nil || ok {
+			return false, err
+		}
+	}
+	br := bufio.NewReader(r)
+	h, err := readHeaderBlock(br)
+	if err != nil {
+		return false, err
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(h))
+	if err != nil {
+		log.Println("Skipping unparseable message", from)
+		return false, nil
+	}
+	labels := takeoutLabels(m.Header.Get(exportLabelsHeader), byName)
+	edits := []headerEdit{{labelsHeader, labels}}
+	if id != "" {
+		edits = append(edits, headerEdit{gmailIdHeader, []string{formatGmailIdHeader(id)}})
+	}
+	k, _, _, err := g.deliverStream(g.dir, io.MultiReader(bytes.NewReader(h), br), labels, edits, date)
+	if err == badMessage {
+		log.Println("Skipping unparseable message", from)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if id != "" {
+		local.byGmailId[id] = k
+	}
+	return true, nil
+}
@@ -0,0 +1,70 @@
+package gmail
+
+import (
+	"fmt"
+	"log"
+)
+
+// Thread is a Gmail thread with messages in the cache.
+type Thread struct {
+	Id string
+	// The Gmail IDs of its cached messages.
+	Msgs []string
+}
+
+// Threads returns the threads recorded in the cache. Threads are only
+// recorded for messages synced since outtake started recording them.
+func (g *Gmail) Threads() ([]Thread, error) {
+	ts := make(chan string)
+	ids, err := collectItems(ts, g.cache.GetThreads(ts))
+	if err != nil {
+		return nil, err
+	}
+	threads := make([]Thread, 0, len(ids))
+	for _, id := range ids {
+		ms, _, err := g.cache.GetThreadMsgs(id)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, Thread{Id: id, Msgs: ms})
+	}
+	return threads, nil
+}
+
+// ThreadFiles returns the maildir files of the cached messages of a thread,
+// skipping those whose files are missing. id is either the thread's Gmail ID,
+// or the Gmail ID of one of its messages.
+func (g *Gmail) ThreadFiles(id string) ([]string, error) {
+	ms, ok, err := g.cache.GetThreadMsgs(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		t, ok, err := g.cache.GetThreadId(id)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("no thread or message %v in the cache", id)
+		}
+		if ms, _, err = g.cache.GetThreadMsgs(t); err != nil {
+			return nil, err
+		}
+	}
+	var files []string
+	for _, m := range ms {
+		k, ok, err := g.cache.GetMsgKey(m)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		fn, err := g.dir.GetFile(k)
+		if err != nil {
+			// Leave the missing file for verify to report.
+			log.Println("Couldn't find the file of message", m, ":", err)
+			continue
+		}
+		files = append(files, fn)
+	}
+	return files, nil
+}
@@ -0,0 +1,497 @@
+package gmail
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/meelapshah/outtake/lib"
+	"github.com/meelapshah/outtake/lib/maildir"
+	"google.golang.org/api/googleapi"
+)
+
+// ProblemKind is a kind of inconsistency found by Verify.
+type ProblemKind int
+
+const (
+	// MissingFile is a cached message whose maildir file is gone.
+	MissingFile ProblemKind = iota
+	// OrphanFile is a maildir file the cache doesn't know about.
+	OrphanFile
+	// LocalLabels is a cached message whose file has different labels.
+	LocalLabels
+	// ServerLabels is a cached message whose labels differ from Gmail's.
+	ServerLabels
+	// DeletedOnServer is a cached message that is no longer in Gmail.
+	DeletedOnServer
+	// NotDownloaded is a Gmail message missing from the cache.
+	NotDownloaded
+	// Corrupt is a message whose file doesn't match the hash recorded when it
+	// was delivered.
+	Corrupt
+	// NoDigest is a message delivered before hashes were recorded.
+	NoDigest
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case MissingFile:
+		return "missing file"
+	case OrphanFile:
+		return "orphan file"
+	case LocalLabels:
+		return "local labels differ"
+	case ServerLabels:
+		return "server labels differ"
+	case DeletedOnServer:
+		return "deleted on server"
+	case NotDownloaded:
+		return "not downloaded"
+	case Corrupt:
+		return "corrupt"
+	case NoDigest:
+		return "no hash recorded"
+	}
+	return "unknown"
+}
+
+// Problem is an inconsistency between the cache, the maildir and Gmail.
+type Problem struct {
+	Kind ProblemKind
+	// Id and Key identify the message, when they are known.
+	Id     string
+	Key    maildir.Key
+	Detail string
+	// Repaired is set if the problem was fixed.
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := p.Kind.String()
+	if p.Id != "" {
+		s += " id=" + p.Id
+	}
+	if p.Key != "" {
+		s += " key=" + string(p.Key)
+	}
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// VerifyOptions selects what Verify checks and whether it repairs problems.
+type VerifyOptions struct {
+	// Server compares the cache with Gmail.
+	Server bool
+	// Scrub re-hashes every file to detect corruption.
+	Scrub bool
+	// Repair fixes the problems found, where possible.
+	Repair bool
+	// Orphan files that can't be matched to a Gmail message are only
+	// reported by Repair, unless QuarantineDir is set, in which case they
+	// are moved there, or DropOrphans is, in which case they are deleted.
+	QuarantineDir string
+	DropOrphans   bool
+}
+
+// VerifyReport lists what Verify found.
+type VerifyReport struct {
+	Checked  uint
+	Problems []Problem
+}
+
+// Repaired returns the number of problems that were fixed.
+func (r *VerifyReport) Repaired() int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// serverMessages returns the IDs of every message on the server that sync
+// would fetch, including, with SyncThreads, the unlabeled messages of the
+// label's threads.
+func (g *Gmail) serverMessages() (map[string]struct{}, error) {
+	seen := make(map[string]struct{})
+	ids := make(chan string)
+	ops := make(chan msgOp)
+	total := uint(0)
+	go g.listMessages(ids, ops, seen, &total, make(chan struct{}))
+	go func() {
+		for range ids {
+		}
+		// listMessages is done with ops once it closes ids.
+		close(ops)
+	}()
+	var err error
+	for o := range ops {
+		if o.Error != nil && err == nil {
+			err = o.Error
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return seen, nil
+}
+
+// Verify cross-checks the cache against the maildir: every cached message
+// must have a file whose labels match the cache, and every file must be
+// cached. Depending on opts, the cache is also checked against Gmail, and
+// files against the hashes recorded when they were delivered. When
+// repairing, orphan files are re-indexed by their X-GM-MSGID header or
+// Message-Id, missing and corrupt files are downloaded again, files are
+// rewritten with the right labels, messages deleted from Gmail are dropped,
+// and orphans that belong to no message are quarantined or deleted if opts
+// asks for it.
+func (g *Gmail) Verify(opts VerifyOptions, progress chan<- lib.Progress) (*VerifyReport, error) {
+	server := opts.Server
+	g.progress = progress
+	r := &VerifyReport{}
+	var remote map[string]struct{}
+	if server {
+		if err := g.resolveLabel(); err != nil {
+			return nil, err
+		}
+		var err error
+		if remote, err = g.serverMessages(); err != nil {
+			return nil, err
+		}
+	}
+	orphans := make(map[maildir.Key]struct{})
+	if err := g.dir.Walk(func(m maildir.Message) error {
+		orphans[m.Key] = struct{}{}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	is := make(chan string)
+	ids, err := collectItems(is, g.cache.GetMsgs(is))
+	if err != nil {
+		return nil, err
+	}
+
+	cached := make(map[string]struct{})
+	for _, id := range ids {
+		cached[id] = struct{}{}
+	}
+	missing := make(map[string]int) // Gmail ID to index in r.Problems.
+	// Labels the file of each message should have, where they differ.
+	relabel := make(map[string][]string)
+	for i, id := range ids {
+		if g.progress != nil {
+			g.progress <- lib.Progress{Current: uint(i), Total: uint(len(ids))}
+		}
+		r.Checked++
+		k, _, err := g.cache.GetMsgKey(id)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := remote[id]; server && !ok {
+			r.Problems = append(r.Problems, Problem{Kind: DeletedOnServer, Id: id, Key: k})
+			delete(orphans, k)
+			continue
+		}
+		fn, err := g.dir.GetFile(k)
+		if err != nil {
+			missing[id] = len(r.Problems)
+			r.Problems = append(r.Problems, Problem{Kind: MissingFile, Id: id, Key: k})
+			continue
+		}
+		delete(orphans, k)
+		if opts.Scrub {
+			if p, ok, err := g.scrub(id, k); err != nil {
+				return nil, err
+			} else if ok {
+				r.Problems = append(r.Problems, p)
+				if p.Kind == Corrupt {
+					continue
+				}
+			}
+		}
+		h, err := g.readHeader(fn)
+		if err != nil && err != maildir.ErrNoIdentity {
+			return nil, err
+		}
+		labels, _, err := g.cache.GetMsgLabels(id)
+		if err != nil {
+			return nil, err
+		}
+		// Encrypted files can't be checked without the key.
+		if local := h[labelsHeader]; h != nil && !sameLabels(local, labels) {
+			r.Problems = append(r.Problems, Problem{Kind: LocalLabels, Id: id, Key: k,
+				Detail: fmt.Sprintf("file has %v, cache has %v", local, labels)})
+			relabel[id] = labels
+		}
+		if server {
+			meta, err := g.svc.GetMetadata(id)
+			if e, ok := err.(*googleapi.Error); ok && e.Code == 404 {
+				r.Problems = append(r.Problems, Problem{Kind: DeletedOnServer, Id: id, Key: k})
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if !sameLabels(meta.LabelIds, labels) {
+				r.Problems = append(r.Problems, Problem{Kind: ServerLabels, Id: id, Key: k,
+					Detail: fmt.Sprintf("Gmail has %v, cache has %v", meta.LabelIds, labels)})
+				relabel[id] = meta.LabelIds
+			}
+		}
+	}
+	if server {
+		skipped, err := g.notDownloadable()
+		if err != nil {
+			return nil, err
+		}
+		for id := range remote {
+			if _, ok := skipped[id]; ok {
+				continue
+			}
+			if _, ok := cached[id]; !ok {
+				r.Problems = append(r.Problems, Problem{Kind: NotDownloaded, Id: id})
+			}
+		}
+	}
+
+	// Orphans are matched to messages whose files are missing, or that
+	// aren't cached at all.
+	reindex := make(map[maildir.Key]msgOp)
+	// Orphans that were read, but belong to no message.
+	unmatched := make(map[maildir.Key]struct{})
+	for k := range orphans {
+		p := Problem{Kind: OrphanFile, Key: k}
+		m, c, err := g.getMaildirMessage(k)
+		if err != nil {
+			p.Detail = err.Error()
+			r.Problems = append(r.Problems, p)
+			continue
+		}
+		c.Close()
+		if id, ok := parseGmailIdHeader(m.Header.Get(gmailIdHeader)); ok {
+			_, isCached := cached[id]
+			_, isMissing := missing[id]
+			_, isRemote := remote[id]
+			if isMissing || (!isCached && (!server || isRemote)) {
+				p.Id = id
+			}
+		} else if mId, err := g.messageIdForKey(k, m); err == nil {
+			gIds, _, err := g.cache.GetGmailIdsForMessageId(mId)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range gIds {
+				if _, ok := missing[id]; ok {
+					p.Id = id
+					break
+				}
+			}
+		}
+		if p.Id != "" {
+			p.Detail = "belongs to " + p.Id
+			reindex[k] = msgOp{Operation: MATCH, Id: p.Id, Key: k, Msg: &mail.Message{Header: m.Header}}
+		} else {
+			unmatched[k] = struct{}{}
+		}
+		r.Problems = append(r.Problems, p)
+	}
+	if !opts.Repair {
+		return r, nil
+	}
+	return r, g.repair(r, missing, relabel, reindex, unmatched, opts)
+}
+
+// scrub checks the file k of message id against the hash recorded for it.
+func (g *Gmail) scrub(id string, k maildir.Key) (Problem, bool, error) {
+	d, ok, err := g.cache.GetMsgDigest(id)
+	if err != nil {
+		return Problem{}, false, err
+	}
+	sum, err := g.sha256File(k)
+	if err == maildir.ErrNoIdentity {
+		return Problem{}, false, nil
+	} else if err != nil {
+		return Problem{Kind: Corrupt, Id: id, Key: k, Detail: err.Error()}, true, nil
+	}
+	if !ok {
+		return Problem{Kind: NoDigest, Id: id, Key: k, Detail: sum}, true, nil
+	} else if sum != d.Sha256 {
+		return Problem{Kind: Corrupt, Id: id, Key: k,
+			Detail: fmt.Sprintf("hash is %s, expected %s", sum, d.Sha256)}, true, nil
+	}
+	return Problem{}, false, nil
+}
+
+// repair fixes the problems found by Verify, marking the ones it fixed.
+func (g *Gmail) repair(r *VerifyReport, missing map[string]int, relabel map[string][]string, reindex map[maildir.Key]msgOp, unmatched map[maildir.Key]struct{}, opts VerifyOptions) error {
+	reindexed := make(map[string]struct{})
+	// Re-index orphans first, so that their messages aren't downloaded again.
+	var order []int
+	for _, orphans := range []bool{true, false} {
+		for i, p := range r.Problems {
+			if (p.Kind == OrphanFile) == orphans {
+				order = append(order, i)
+			}
+		}
+	}
+	for _, i := range order {
+		p := &r.Problems[i]
+		var err error
+		switch p.Kind {
+		case OrphanFile:
+			o, ok := reindex[p.Key]
+			if !ok {
+				if _, ok := unmatched[p.Key]; !ok {
+					continue
+				} else if opts.QuarantineDir != "" {
+					_, err = g.dir.MoveOut(p.Key, opts.QuarantineDir)
+				} else if opts.DropOrphans {
+					err = g.dir.Delete(p.Key)
+				} else {
+					continue
+				}
+				if err != nil {
+					log.Println("Couldn't repair", p, ":", err)
+				} else {
+					p.Repaired = true
+				}
+				continue
+			}
+			if _, dup := reindexed[o.Id]; dup {
+				continue
+			}
+			// Keep the labels the file has, unless we know better.
+			o.Labels = o.Msg.Header[labelsHeader]
+			if ls, ok := relabel[o.Id]; ok {
+				o.Labels = ls
+			} else if opts.Server {
+				meta, err := g.svc.GetMetadata(o.Id)
+				if err != nil {
+					return err
+				}
+				o.Labels = meta.LabelIds
+			}
+			err = g.writeBatch(func(b *batch) error { return g.writeMatch(b, o) })
+			reindexed[o.Id] = struct{}{}
+			if j, ok := missing[o.Id]; ok {
+				r.Problems[j].Repaired = err == nil
+			}
+		case MissingFile, Corrupt:
+			if _, ok := reindexed[p.Id]; ok {
+				continue
+			}
+			// Forget the message, then download it again.
+			if err = g.writeBatch(func(b *batch) error { return g.writeDel(b, p.Id) }); err == nil {
+				var added bool
+				if added, err = g.redownload(p.Id); err == nil && !added {
+					continue
+				}
+			}
+		case LocalLabels, ServerLabels:
+			ls, ok := relabel[p.Id]
+			if !ok {
+				// Already rewritten for another problem.
+				p.Repaired = true
+				continue
+			}
+			delete(relabel, p.Id)
+			err = g.writeBatch(func(b *batch) error {
+				return g.writeLabels(b, p.Id, ls)
+			})
+		case DeletedOnServer:
+			err = g.writeBatch(func(b *batch) error { return g.writeDel(b, p.Id) })
+		case NoDigest:
+			// Trust the file as it is now.
+			err = g.writeBatch(func(b *batch) error { return b.cache.SetMsgSha256(p.Id, p.Detail) })
+		case NotDownloaded:
+			if _, ok := reindexed[p.Id]; ok {
+				p.Repaired = true
+				continue
+			}
+			var added bool
+			if added, err = g.redownload(p.Id); err == nil && !added {
+				continue
+			}
+		}
+		if err != nil {
+			log.Println("Couldn't repair", p, ":", err)
+			continue
+		}
+		if p.Kind != OrphanFile || p.Id != "" {
+			p.Repaired = true
+		}
+	}
+	return nil
+}
+
+// redownload downloads message id and adds it to the cache. It reports
+// whether the message was delivered, which it isn't when sync would leave it
+// out too.
+func (g *Gmail) redownload(id string) (bool, error) {
+	o := g.handleNewMsg(id)
+	if o.Error != nil {
+		return false, o.Error
+	}
+	if o.Operation != ADD {
+		return false, nil
+	}
+	return true, g.writeBatch(func(b *batch) error { return g.writeOperation(b, o) })
+}
+
+// notDownloadable returns the IDs of server messages that sync deliberately
+// doesn't download: those excluded by the retention policy, and the messages
+// of drafts synced by SyncDrafts.
+func (g *Gmail) notDownloadable() (map[string]struct{}, error) {
+	skipped := make(map[string]struct{})
+	ms := make(chan string)
+	excluded, err := collectItems(ms, g.cache.GetExcluded(ms))
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range excluded {
+		skipped[id] = struct{}{}
+	}
+	if !SyncDrafts {
+		return skipped, nil
+	}
+	ds := make(chan string)
+	drafts, err := collectItems(ds, g.cache.GetDrafts(ds))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range drafts {
+		s, ok, err := g.cache.GetDraft(d)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			skipped[s.MsgId] = struct{}{}
+		}
+	}
+	return skipped, nil
+}
+
+// Summary describes the report in a sentence.
+func (r *VerifyReport) Summary() string {
+	if len(r.Problems) == 0 {
+		return fmt.Sprintf("Checked %d messages, no problems found.", r.Checked)
+	}
+	counts := make(map[ProblemKind]int)
+	for _, p := range r.Problems {
+		counts[p.Kind]++
+	}
+	var parts []string
+	for k := MissingFile; k <= NoDigest; k++ {
+		if n := counts[k]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, k))
+		}
+	}
+	return fmt.Sprintf("Checked %d messages: %s; repaired %d of %d problems.",
+		r.Checked, strings.Join(parts, ", "), r.Repaired(), len(r.Problems))
+}
@@ -0,0 +1,272 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/meelapshah/outtake/lib"
+)
+
+// Compression is how message files are stored.
+type Compression string
+
+const (
+	NoCompression Compression = ""
+	Gzip          Compression = "gzip"
+	Zstd          Compression = "zstd"
+
+	// compressedFlag marks compressed messages in cur, as Dovecot's zlib
+	// plugin does. Files in new can't carry flags, so readers go by the
+	// content of the file rather than trusting the flag.
+	compressedFlag = "Z"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ParseCompression parses the name of a compression method; "" and "none"
+// mean no compression.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(strings.ToLower(s)); c {
+	case NoCompression, "none":
+		return NoCompression, nil
+	case Gzip, Zstd:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, expected gzip, zstd or none", s)
+}
+
+// WithCompression returns the maildir, storing newly delivered messages with
+// compression c. Messages are read whatever their compression.
+func (d Maildir) WithCompression(c Compression) Maildir {
+	d.compress = c
+	return d
+}
+
+// KeepingCompression returns the maildir, with Convert keeping the
+// compression of each message rather than applying the maildir's, e.g. to
+// only encrypt or decrypt the messages.
+func (d Maildir) KeepingCompression() Maildir {
+	d.keepCompression = true
+	return d
+}
+
+// Compression returns the compression newly delivered messages are stored
+// with.
+func (d Maildir) Compression() Compression {
+	return d.compress
+}
+
+// compressor wraps w so that what is written to it is compressed with c. The
+// returned writer must be closed to flush it.
+func compressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// detect returns the compression of the file r reads, without consuming it.
+func detect(r *bufio.Reader) (Compression, error) {
+	magic, err := r.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if bytes.HasPrefix(magic, gzipMagic) {
+		return Gzip, nil
+	} else if bytes.HasPrefix(magic, zstdMagic) {
+		return Zstd, nil
+	}
+	return NoCompression, nil
+}
+
+// decoder reads a message, closing the decompressing and decrypting readers
+// and the file under them when it is closed.
+type decoder struct {
+	io.Reader
+	closers []func() error
+}
+
+func (d *decoder) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if e := c(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// decompress returns a reader of the message br reads, decompressing it if
+// need be.
+func decompress(br *bufio.Reader) (*decoder, error) {
+	c, err := detect(br)
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case Gzip:
+		z, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return &decoder{z, []func() error{z.Close}}, nil
+	case Zstd:
+		z, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return &decoder{z, []func() error{func() error { z.Close(); return nil }}}, nil
+	}
+	return &decoder{Reader: br}, nil
+}
+
+// isCompressed reports whether the message in file fn is compressed. The
+// maildir's compression is assumed for encrypted files it can't decrypt.
+func (d Maildir) isCompressed(fn string) (bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	br, _, err := d.decrypt(bufio.NewReader(f))
+	if err == ErrNoIdentity {
+		return d.compress != NoCompression, nil
+	} else if err != nil {
+		return false, err
+	}
+	c, err := detect(br)
+	return c != NoCompression, err
+}
+
+// withFlag returns the maildir flags fs with f added or removed, in the ASCII
+// order the spec requires.
+func withFlag(fs, f string, set bool) string {
+	fs = strings.Replace(fs, f, "", -1)
+	if !set {
+		return fs
+	}
+	s := strings.Split(fs+f, "")
+	sort.Strings(s)
+	return strings.Join(s, "")
+}
+
+// Convert rewrites every message in the maildir with the compression and
+// encryption it was given with WithCompression and WithEncryption, e.g. to
+// compress an existing maildir. With KeepingCompression, messages keep their
+// own compression. Encrypted messages are only decrypted if
+// decrypt is set, and are left alone if they would need decrypting but the
+// maildir has no identities. Each message is written to tmp and synced
+// before it replaces the original, so an interruption leaves every message
+// readable; running Convert again finishes the job. Nothing else should write
+// to the maildir meanwhile. Convert returns the number of messages it
+// rewrote.
+func (d Maildir) Convert(decrypt bool, progress chan<- lib.Progress) (int, error) {
+	var ms []Message
+	if err := d.Walk(func(m Message) error {
+		ms = append(ms, m)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	n := 0
+	for i, m := range ms {
+		if progress != nil {
+			progress <- lib.Progress{Current: uint(i), Total: uint(len(ms))}
+		}
+		if ok, err := d.convert(m, decrypt); err != nil {
+			return n, fmt.Errorf("converting %s: %v", m.Path, err)
+		} else if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// convert rewrites message m with the maildir's compression and encryption,
+// if it doesn't have them already, keeping its key, flags and times.
+func (d Maildir) convert(m Message, decrypt bool) (bool, error) {
+	f, err := os.Open(m.Path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	enc, err := isEncrypted(br)
+	if err != nil {
+		return false, err
+	}
+	encrypt := len(d.recipients) > 0
+	if enc && ((!encrypt && !decrypt) || len(d.identities) == 0) {
+		return false, nil
+	}
+	pr, _, err := d.decrypt(br)
+	if err != nil {
+		return false, err
+	}
+	c, err := detect(pr)
+	if err != nil {
+		return false, err
+	}
+	if d.keepCompression {
+		d.compress = c
+	}
+	if enc == encrypt && c == d.compress {
+		return false, nil
+	}
+	r, err := decompress(pr)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	q := atomic.AddUint64(&cntr, 1)
+	tmpPath := path.Join(d.dir, tmp, fmt.Sprintf("%d.P%dQ%d.%s", time.Now().Unix(), pid, q, hostname))
+	if _, _, err := d.writeTmp(tmpPath, r); err != nil {
+		return false, err
+	}
+	sub, name := cur, path.Base(m.Path)
+	if m.New {
+		sub = nw
+	} else if strings.HasPrefix(strings.TrimPrefix(name, string(m.Key)), ":2,") {
+		name = string(m.Key) + ":2," + withFlag(m.Flags, compressedFlag, d.compress != NoCompression)
+	}
+	to := path.Join(d.dir, sub, name)
+	if err := os.Rename(tmpPath, to); err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	d.idx.set(d.dir, m.Key, path.Join(sub, name))
+	if to != m.Path {
+		if err := os.Remove(m.Path); err != nil {
+			return true, err
+		}
+	}
+	if err := os.Chtimes(to, m.ModTime, m.ModTime); err != nil {
+		return true, err
+	}
+	if err := syncDir(path.Join(d.dir, sub)); err != nil {
+		return true, err
+	}
+	return true, syncDir(path.Join(d.dir, tmp))
+}
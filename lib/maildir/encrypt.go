@@ -0,0 +1,150 @@
+package maildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"filippo.io/age"
+)
+
+// ageMagic starts every file encrypted with age.
+var ageMagic = []byte("age-encryption.org/v1\n")
+
+// ErrNoIdentity is returned when reading an encrypted message from a maildir
+// that wasn't given the identities to decrypt it.
+var ErrNoIdentity = errors.New("message is encrypted, and no identity to decrypt it was given")
+
+// ErrNoRecipient is returned when rewriting an encrypted message in a maildir
+// that can't encrypt it again.
+var ErrNoRecipient = errors.New("message is encrypted, and no recipient to encrypt it to again was given")
+
+// WithEncryption returns the maildir, encrypting newly delivered messages to
+// recipients with age, and decrypting messages with identities. Either may be
+// empty: delivering only needs the recipients, so the identities can be kept
+// away from the machine syncing the maildir.
+func (d Maildir) WithEncryption(recipients []age.Recipient, identities []age.Identity) Maildir {
+	d.recipients, d.identities = recipients, identities
+	return d
+}
+
+// Encrypts reports whether newly delivered messages are encrypted.
+func (d Maildir) Encrypts() bool {
+	return len(d.recipients) > 0
+}
+
+// ForRewrite returns the maildir to deliver a rewritten copy of the message
+// file fn to. If the maildir has no recipients and fn is encrypted, the copy
+// is encrypted to the recipients of the maildir's X25519 identities, so that
+// rewriting a message never leaves it in the clear; without such identities,
+// ForRewrite fails with ErrNoRecipient.
+func (d Maildir) ForRewrite(fn string) (Maildir, error) {
+	if len(d.recipients) > 0 {
+		return d, nil
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+	if enc, err := isEncrypted(bufio.NewReader(f)); err != nil || !enc {
+		return d, err
+	}
+	for _, id := range d.identities {
+		if x, ok := id.(*age.X25519Identity); ok {
+			d.recipients = append(d.recipients, x.Recipient())
+		}
+	}
+	if len(d.recipients) == 0 {
+		return d, ErrNoRecipient
+	}
+	return d, nil
+}
+
+// LoadKeys parses age recipients, e.g. "age1...", and reads the identities in
+// the file identityFile, if it isn't empty.
+func LoadKeys(recipients []string, identityFile string) ([]age.Recipient, []age.Identity, error) {
+	var rs []age.Recipient
+	for _, s := range recipients {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		rs = append(rs, r)
+	}
+	if identityFile == "" {
+		return rs, nil, nil
+	}
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	ids, err := age.ParseIdentities(f)
+	return rs, ids, err
+}
+
+// isEncrypted reports whether br reads an encrypted message, without consuming
+// it.
+func isEncrypted(br *bufio.Reader) (bool, error) {
+	magic, err := br.Peek(len(ageMagic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(magic, ageMagic), nil
+}
+
+// decrypt returns a reader of the message br reads, decrypting it if need be.
+func (d Maildir) decrypt(br *bufio.Reader) (*bufio.Reader, bool, error) {
+	if enc, err := isEncrypted(br); err != nil || !enc {
+		return br, false, err
+	}
+	if len(d.identities) == 0 {
+		return nil, true, ErrNoIdentity
+	}
+	r, err := age.Decrypt(br, d.identities...)
+	if err != nil {
+		return nil, true, err
+	}
+	return bufio.NewReader(r), true, nil
+}
+
+// encoder compresses and encrypts what is written to it, as the maildir is
+// configured to, and flushes both when closed.
+type encoder struct {
+	io.Writer
+	closers []io.Closer
+}
+
+func (e *encoder) Close() error {
+	for _, c := range e.closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encoder returns a writer that compresses and encrypts messages written to
+// w. Compression comes first, as encrypted data doesn't compress.
+func (d Maildir) encoder(w io.Writer) (io.WriteCloser, error) {
+	e := &encoder{}
+	if len(d.recipients) > 0 {
+		a, err := age.Encrypt(w, d.recipients...)
+		if err != nil {
+			return nil, err
+		}
+		w = a
+		e.closers = append(e.closers, a)
+	}
+	c, err := compressor(w, d.compress)
+	if err != nil {
+		return nil, err
+	}
+	e.Writer = c
+	// The compressor must be flushed before the encryption.
+	e.closers = append([]io.Closer{c}, e.closers...)
+	return e, nil
+}
@@ -0,0 +1,164 @@
+package maildir
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// index maps message keys to their files, so that looking up a message
+// doesn't mean listing cur. It is built on first use and kept up to date with
+// our own deliveries and deletions. Other processes, such as a MUA changing
+// flags, may rename files behind our back: a lookup whose file is gone
+// rebuilds the index, and one for a key the index doesn't have rebuilds it if
+// new or cur have been modified since, other than by us.
+type index struct {
+	sync.Mutex
+	// Paths relative to the maildir, e.g. "cur/<key>:2,S".
+	paths map[Key]string
+	// Modification times of new and cur when paths was built, or last
+	// updated by us.
+	mtimes [2]time.Time
+}
+
+// keyForName returns the key of the message file name.
+func keyForName(name string) Key {
+	return Key(strings.SplitN(name, ":", 2)[0])
+}
+
+// dirMtimes returns the modification times of new and cur.
+func dirMtimes(dir string) ([2]time.Time, error) {
+	var ts [2]time.Time
+	for i, t := range []string{nw, cur} {
+		fi, err := os.Stat(path.Join(dir, t))
+		if err != nil {
+			return ts, err
+		}
+		ts[i] = fi.ModTime()
+	}
+	return ts, nil
+}
+
+// build lists new and cur into the index. Must be called with the lock held.
+func (x *index) build(dir string) error {
+	// Take the times first, so that changes made while listing trigger another
+	// rebuild.
+	ts, err := dirMtimes(dir)
+	if err != nil {
+		return err
+	}
+	paths := make(map[Key]string)
+	for _, t := range []string{nw, cur} {
+		f, err := os.Open(path.Join(dir, t))
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			paths[keyForName(n)] = path.Join(t, n)
+		}
+	}
+	x.paths, x.mtimes = paths, ts
+	return nil
+}
+
+// stale reports whether new or cur have changed since the index was built.
+// Must be called with the lock held.
+func (x *index) stale(dir string) (bool, error) {
+	ts, err := dirMtimes(dir)
+	return ts != x.mtimes, err
+}
+
+// lookup returns the path of the file for k, if the index has one that
+// still exists. Must be called with the lock held.
+func (x *index) lookup(dir string, k Key) (string, bool) {
+	p, ok := x.paths[k]
+	if !ok {
+		return "", false
+	}
+	f := path.Join(dir, p)
+	if _, err := os.Stat(f); err != nil {
+		return "", false
+	}
+	return f, true
+}
+
+// find returns the path of the file for k, rebuilding the index if it may
+// be out of date.
+func (x *index) find(dir string, k Key) (string, bool, error) {
+	x.Lock()
+	defer x.Unlock()
+	if x.paths == nil {
+		if err := x.build(dir); err != nil {
+			return "", false, err
+		}
+	}
+	if f, ok := x.lookup(dir, k); ok {
+		return f, true, nil
+	}
+	// A file the index has that is gone was renamed or removed behind our
+	// back. Otherwise, new or cur only hold k if someone else changed them.
+	if _, ok := x.paths[k]; !ok {
+		if stale, err := x.stale(dir); err != nil || !stale {
+			return "", false, err
+		}
+	}
+	if err := x.build(dir); err != nil {
+		return "", false, err
+	}
+	f, ok := x.lookup(dir, k)
+	return f, ok, nil
+}
+
+// rescan rebuilds the index, and returns the messages whose files it no
+// longer finds where it had them.
+func (x *index) rescan(dir string) ([]Rename, error) {
+	x.Lock()
+	defer x.Unlock()
+	old := x.paths
+	if err := x.build(dir); err != nil {
+		return nil, err
+	}
+	var rs []Rename
+	for k, p := range old {
+		if q := x.paths[k]; q != p {
+			rs = append(rs, Rename{k, p, q})
+		}
+	}
+	return rs, nil
+}
+
+// set records that k is in the file rel, relative to the maildir dir.
+func (x *index) set(dir string, k Key, rel string) {
+	x.Lock()
+	defer x.Unlock()
+	if x.paths != nil {
+		x.paths[k] = rel
+		x.touched(dir)
+	}
+}
+
+// del records that k's file was removed from the maildir dir.
+func (x *index) del(dir string, k Key) {
+	x.Lock()
+	defer x.Unlock()
+	if x.paths != nil {
+		delete(x.paths, k)
+		x.touched(dir)
+	}
+}
+
+// touched takes the modification times of new and cur after a change of
+// ours, so that it doesn't make the index stale: otherwise every miss after a
+// delivery would rebuild it. Must be called with the lock held.
+func (x *index) touched(dir string) {
+	if ts, err := dirMtimes(dir); err == nil {
+		x.mtimes = ts
+	}
+}
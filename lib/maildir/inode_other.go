@@ -0,0 +1,13 @@
+//go:build !unix
+
+package maildir
+
+import (
+	"os"
+)
+
+// inode returns the inode and device numbers of fi, which aren't available
+// on this platform.
+func inode(fi os.FileInfo) (uint64, uint64, bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package maildir
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode returns the inode and device numbers of fi.
+func inode(fi os.FileInfo) (uint64, uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Ino), uint64(st.Dev), true
+}
@@ -2,22 +2,27 @@
 package maildir
 
 import (
+	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/mail"
+	"log"
 	"os"
 	"path"
-	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
+
+	"filippo.io/age"
 )
 
 const (
 	cur = "cur"
 	tmp = "tmp"
 	nw  = "new"
+
+	// How long files may sit in tmp before they are considered abandoned.
+	staleTmpAge = 36 * time.Hour
 )
 
 var (
@@ -29,90 +34,199 @@ var (
 func init() {
 	pid = os.Getpid()
 	h, _ := os.Hostname()
-	hostname = strings.Replace(strings.Replace(h, "/", "\057", -1), ":", "\072", -1)
+	hostname = escapeHostname(h)
+}
+
+// escapeHostname escapes the characters of hostname h that can't be in a
+// message file name: the spec reserves "/" and ":", and Dovecot "," for the
+// size.
+func escapeHostname(h string) string {
+	return strings.NewReplacer("/", `\057`, ":", `\072`, ",", `\054`).Replace(h)
 }
 
 // Key is a key of a maildir message.
 type Key string
 
 type Maildir struct {
-	dir string
+	dir        string
+	idx        *index
+	compress   Compression
+	recipients []age.Recipient
+	identities []age.Identity
+	// Whether Convert keeps each message's compression.
+	keepCompression bool
 }
 
 // Create creates a maildir rooted at dir.
 func Create(dir string) (Maildir, error) {
-	m := Maildir{dir}
+	m := Maildir{dir: dir, idx: &index{}}
 	for _, x := range []string{cur, tmp, nw} {
 		if err := os.MkdirAll(path.Join(dir, x), 0766); err != nil {
 			return m, err
 		}
 	}
-	return m, nil
+	return m, m.CleanTmp()
 }
 
 func (d Maildir) GetDir() string {
 	return d.dir
 }
 
-func (d Maildir) DeliverNew(m *mail.Message) (Key, error) {
-	return d.deliver(m, nw)
+// Folder creates the Maildir++ folder name, e.g. ".Drafts", inside the
+// maildir. Its messages are compressed and encrypted as the maildir's are.
+func (d Maildir) Folder(name string) (Maildir, error) {
+	f, err := Create(path.Join(d.dir, name))
+	return f.WithCompression(d.compress).WithEncryption(d.recipients, d.identities), err
 }
 
-func (d Maildir) DeliverCur(m *mail.Message) (Key, error) {
-	return d.deliver(m, cur)
+// DeliverRaw delivers the message read from r byte for byte. Messages without
+// flags are delivered to "new"; others are delivered to "cur" with the given
+// maildir flags, e.g. "S" for seen.
+//
+// The message is written to "tmp" and synced to disk before being moved into
+// place, so that a crash never leaves a partial message behind. Its name
+// follows the maildir spec: the delivery time in seconds, then a unique part
+// made of the microseconds (M), process ID (P), random bits (R), inode (I) and
+// device (V) of the file and a delivery counter (Q), then the hostname and,
+// as Dovecot expects, the message size (S).
+func (d Maildir) DeliverRaw(r io.Reader, flags string) (Key, error) {
+	return d.DeliverRawAt(r, flags, time.Time{})
 }
 
-// Deliver delivers the Message to the "new" maildir.
-func (d Maildir) deliver(m *mail.Message, t string) (Key, error) {
-	k := strconv.FormatInt(time.Now().Unix(), 10) + "."
-	k += strconv.FormatInt(int64(pid), 10) + "_" + strconv.FormatUint(atomic.AddUint64(&cntr, 1), 10)
-	k += "." + hostname
-	key := Key(k)
-	f, err := os.Create(path.Join(d.dir, tmp, k))
+// DeliverRawAt is like DeliverRaw, but dates the message at t rather than
+// now: t is used for the seconds in its name and for the modification and
+// access times of its file, which mail readers sort on as the time the
+// message was received. A zero t means now.
+func (d Maildir) DeliverRawAt(r io.Reader, flags string, t time.Time) (Key, error) {
+	now := time.Now()
+	if t.IsZero() {
+		t = now
+	}
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		return "", err
+	}
+	unique := fmt.Sprintf("M%dP%dR%x", now.Nanosecond()/1000, pid, rnd)
+	q := fmt.Sprintf("Q%d", atomic.AddUint64(&cntr, 1))
+	tmpPath := path.Join(d.dir, tmp, fmt.Sprintf("%d.%s%s.%s", t.Unix(), unique, q, hostname))
+	size, fi, err := d.writeTmp(tmpPath, r)
 	if err != nil {
-		return key, err
+		return "", err
 	}
-	defer f.Close()
-	for h, vs := range m.Header {
-		for _, v := range vs {
-			if _, err := f.WriteString(h + ": " + v + "\n"); err != nil {
-				return key, err
-			}
-		}
+	if ino, dev, ok := inode(fi); ok {
+		unique += fmt.Sprintf("I%xV%x", ino, dev)
+	}
+	key := Key(fmt.Sprintf("%d.%s%s.%s,S=%d", t.Unix(), unique, q, hostname, size))
+
+	sub, name := nw, string(key)
+	if flags != "" {
+		flags = withFlag(flags, compressedFlag, d.compress != NoCompression)
+		sub, name = cur, name+":2,"+flags
 	}
-	if _, err := f.WriteString("\r\n"); err != nil {
-		return key, err
+	to := path.Join(d.dir, sub, name)
+	if err := os.Rename(tmpPath, to); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	d.idx.set(d.dir, key, path.Join(sub, name))
+	// Dated only once out of tmp, where CleanTmp would take an old date for
+	// an abandoned delivery. The message is delivered all the same if that
+	// fails.
+	if err := os.Chtimes(to, t, t); err != nil {
+		log.Println("Couldn't date message", key, ":", err)
 	}
-	if _, err := io.Copy(f, m.Body); err != nil {
-		return key, err
+	err = syncDir(path.Join(d.dir, sub))
+	if err == nil {
+		err = syncDir(path.Join(d.dir, tmp))
 	}
+	if err != nil {
+		// Undo the delivery, so that the caller doesn't have to clean up a
+		// message it has no key for.
+		os.Remove(to)
+		d.idx.del(d.dir, key)
+		return "", err
+	}
+	return key, nil
+}
 
-	targetPath := path.Join(d.dir, t, k)
-	if t == cur {
-		// Add the maildir seen flag to messages delivered to the cur folder
-		targetPath += ":2,S"
+// writeTmp writes the message read from r to the new file tmpPath, compressed
+// and encrypted as configured, and syncs it. It returns the uncompressed size
+// of the message, which is what Dovecot expects in the name, and the file's
+// info. The file is removed if anything goes wrong.
+func (d Maildir) writeTmp(tmpPath string, r io.Reader) (int64, os.FileInfo, error) {
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, nil, err
+	}
+	written := false
+	defer func() {
+		if !written {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	w, err := d.encoder(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	size, err := io.Copy(w, r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, nil, err
 	}
-	return key, os.Rename(path.Join(d.dir, tmp, k), targetPath)
+	if err := f.Sync(); err != nil {
+		return 0, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, nil, err
+	}
+	written = true
+	return size, fi, nil
 }
 
-// GetFile gets the file path for the specified key.
-func (d Maildir) GetFile(k Key) (string, error) {
-	// Check in new.
-	f := path.Join(d.dir, nw, string(k))
-	if _, err := os.Stat(f); err == nil {
-		return f, nil
+// syncDir flushes the directory dir, making renames into or out of it
+// durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
 	}
-	// Check in cur.
-	fs, err := ioutil.ReadDir(path.Join(d.dir, cur))
+	defer f.Close()
+	return f.Sync()
+}
+
+// CleanTmp removes files left in "tmp" by deliveries that were interrupted
+// more than 36 hours ago, as the maildir spec recommends.
+func (d Maildir) CleanTmp() error {
+	fs, err := ioutil.ReadDir(path.Join(d.dir, tmp))
 	if err != nil {
-		return "", err
+		return err
 	}
 	for _, f := range fs {
-		if strings.HasPrefix(f.Name(), string(k)+":") {
-			return path.Join(d.dir, cur, f.Name()), nil
+		if !f.IsDir() && time.Since(f.ModTime()) > staleTmpAge {
+			if err := os.Remove(path.Join(d.dir, tmp, f.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
 		}
 	}
-	return "", fmt.Errorf("Does not exist")
+	return nil
+}
+
+// GetFile gets the file path for the specified key.
+func (d Maildir) GetFile(k Key) (string, error) {
+	f, ok, err := d.idx.find(d.dir, k)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return "", fmt.Errorf("Does not exist")
+	}
+	return f, nil
 }
 
 // Delete removes the message with the specified key from cur/new.
@@ -121,5 +235,19 @@ func (d Maildir) Delete(k Key) error {
 	if err != nil {
 		return err
 	}
-	return os.Remove(f)
+	if err := os.Remove(f); err != nil {
+		return err
+	}
+	d.idx.del(d.dir, k)
+	return nil
+}
+
+// Keys returns the keys of all messages in cur and new.
+func (d Maildir) Keys() ([]Key, error) {
+	var ks []Key
+	err := d.Walk(func(m Message) error {
+		ks = append(ks, m.Key)
+		return nil
+	})
+	return ks, err
 }
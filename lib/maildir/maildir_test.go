@@ -0,0 +1,360 @@
+package maildir
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+func newTestMaildir() Maildir {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		panic(err)
+	}
+	d, err := Create(dir)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func deliverTest(d Maildir, body, flags string) Key {
+	k, err := d.DeliverRaw(strings.NewReader(body), flags)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// touchDir sets the modification time of sub of d to t, as another process
+// changing it would.
+func touchDir(d Maildir, sub string, t time.Time) {
+	if err := os.Chtimes(path.Join(d.dir, sub), t, t); err != nil {
+		panic(err)
+	}
+}
+
+func TestIndexOutsideRename(t *testing.T) {
+	d := newTestMaildir()
+	k := deliverTest(d, "Subject: a\r\n\r\na\r\n", "S")
+	fn, err := d.GetFile(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A mail reader marks it replied.
+	renamed := path.Join(d.dir, cur, string(k)+":2,RS")
+	if err := os.Rename(fn, renamed); err != nil {
+		panic(err)
+	}
+	if fn, err := d.GetFile(k); err != nil || fn != renamed {
+		t.Errorf(`GetFile() = %v, %v, expected %v`, fn, err, renamed)
+	}
+	// And moves it back to new.
+	moved := path.Join(d.dir, nw, string(k))
+	if err := os.Rename(renamed, moved); err != nil {
+		panic(err)
+	}
+	if fn, err := d.GetFile(k); err != nil || fn != moved {
+		t.Errorf(`GetFile() = %v, %v, expected %v`, fn, err, moved)
+	}
+	if err := os.Remove(moved); err != nil {
+		panic(err)
+	}
+	if fn, err := d.GetFile(k); err == nil {
+		t.Errorf(`GetFile() = %v, expected an error for a removed file`, fn)
+	}
+}
+
+func TestIndexRebuild(t *testing.T) {
+	d := newTestMaildir()
+	k := deliverTest(d, "Subject: a\r\n\r\na\r\n", "S")
+	if _, err := d.GetFile(k); err != nil {
+		t.Fatal(err)
+	}
+	d.idx.paths["marker"] = "cur/marker"
+
+	// Misses after our own deliveries and deletions don't rebuild the index.
+	k2 := deliverTest(d, "Subject: b\r\n\r\nb\r\n", "")
+	if err := d.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	if fn, err := d.GetFile("missing"); err == nil {
+		t.Errorf(`GetFile() = %v, expected an error for a missing key`, fn)
+	}
+	if _, ok := d.idx.paths["marker"]; !ok {
+		t.Errorf(`GetFile() rebuilt the index after our own changes`)
+	}
+	if fn, err := d.GetFile(k2); err != nil || path.Dir(fn) != path.Join(d.dir, nw) {
+		t.Errorf(`GetFile() = %v, %v, expected a file in new`, fn, err)
+	}
+
+	// A message delivered by someone else is found once cur changes.
+	outside := path.Join(d.dir, cur, "1500000000.outside.host:2,S")
+	if err := ioutil.WriteFile(outside, []byte("Subject: c\r\n\r\nc\r\n"), 0600); err != nil {
+		panic(err)
+	}
+	touchDir(d, cur, time.Now().Add(time.Hour))
+	if fn, err := d.GetFile("1500000000.outside.host"); err != nil || fn != outside {
+		t.Errorf(`GetFile() = %v, %v, expected %v`, fn, err, outside)
+	}
+	if _, ok := d.idx.paths["marker"]; ok {
+		t.Errorf(`GetFile() didn't rebuild the index after cur changed`)
+	}
+}
+
+func TestParseName(t *testing.T) {
+	for _, c := range []struct{ name, key, flags string }{
+		{"1500000000.M1P2.host,S=10", "1500000000.M1P2.host,S=10", ""},
+		{"1500000000.M1P2.host,S=10:2,RS", "1500000000.M1P2.host,S=10", "RS"},
+		{"1500000000.M1P2.host:2,", "1500000000.M1P2.host", ""},
+		{"1500000000.M1P2.host:1,experimental", "1500000000.M1P2.host", ""},
+	} {
+		if k, flags := parseName(c.name); string(k) != c.key || flags != c.flags {
+			t.Errorf(`parseName(%q) = %q, %q, expected %q, %q`, c.name, k, flags, c.key, c.flags)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	d := newTestMaildir()
+	kn := deliverTest(d, "Subject: a\r\n\r\na\r\n", "")
+	kc := deliverTest(d, "Subject: b\r\n\r\nbb\r\n", "RS")
+	// Dot files and directories aren't messages.
+	if err := ioutil.WriteFile(path.Join(d.dir, cur, ".hidden"), nil, 0600); err != nil {
+		panic(err)
+	}
+	if err := os.Mkdir(path.Join(d.dir, cur, "sub"), 0700); err != nil {
+		panic(err)
+	}
+	ms := make(map[Key]Message)
+	if err := d.Walk(func(m Message) error {
+		ms[m.Key] = m
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 {
+		t.Errorf(`Walk() found %v messages, expected 2`, len(ms))
+	}
+	if m := ms[kn]; !m.New || m.Flags != "" || m.Size != 17 || m.Path != path.Join(d.dir, nw, string(kn)) {
+		t.Errorf(`Walk() = %+v, expected a new message of 17 bytes`, m)
+	}
+	if m := ms[kc]; m.New || m.Flags != "RS" || m.Size != 18 || m.Path != path.Join(d.dir, cur, string(kc)+":2,RS") {
+		t.Errorf(`Walk() = %+v, expected a cur message of 18 bytes flagged RS`, m)
+	}
+
+	stop := os.ErrInvalid
+	n := 0
+	if err := d.Walk(func(Message) error {
+		n++
+		return stop
+	}); err != stop || n != 1 {
+		t.Errorf(`Walk() = %v after %v calls, expected %v after 1`, err, n, stop)
+	}
+}
+
+func TestMoveToCur(t *testing.T) {
+	d := newTestMaildir()
+	k := deliverTest(d, "Subject: a\r\n\r\na\r\n", "")
+	fn, err := d.MoveToCur(k)
+	if expected := path.Join(d.dir, cur, string(k)+":2,"); err != nil || fn != expected {
+		t.Errorf(`MoveToCur() = %v, %v, expected %v`, fn, err, expected)
+	}
+	if f, err := d.GetFile(k); err != nil || f != fn {
+		t.Errorf(`GetFile() = %v, %v, expected %v`, f, err, fn)
+	}
+	if _, err := os.Stat(path.Join(d.dir, nw, string(k))); !os.IsNotExist(err) {
+		t.Errorf(`MoveToCur() left the file in new`)
+	}
+
+	// Messages in cur keep their flags.
+	k2 := deliverTest(d, "Subject: b\r\n\r\nb\r\n", "S")
+	before, _ := d.GetFile(k2)
+	if fn, err := d.MoveToCur(k2); err != nil || fn != before {
+		t.Errorf(`MoveToCur() = %v, %v, expected %v`, fn, err, before)
+	}
+	if _, err := d.MoveToCur("missing"); err == nil {
+		t.Errorf(`MoveToCur() succeeded for a missing key`)
+	}
+
+	// Compressed messages keep their marker.
+	z := d.WithCompression(Gzip)
+	k3 := deliverTest(z, "Subject: c\r\n\r\nc\r\n", "")
+	if fn, err := z.MoveToCur(k3); err != nil || !strings.HasSuffix(fn, ":2,Z") {
+		t.Errorf(`MoveToCur() of a compressed message = %v, %v, expected the Z flag`, fn, err)
+	}
+}
+
+func TestConvertKeepingCompression(t *testing.T) {
+	d := newTestMaildir()
+	k := deliverTest(d.WithCompression(Gzip), "Subject: a\r\n\r\na\r\n", "S")
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		panic(err)
+	}
+	e := d.WithEncryption([]age.Recipient{id.Recipient()}, []age.Identity{id}).KeepingCompression()
+	if n, err := e.Convert(false, nil); err != nil || n != 1 {
+		t.Fatalf(`Convert() = %v, %v, expected 1 message rewritten`, n, err)
+	}
+	fn, err := e.GetFile(k)
+	if err != nil || !strings.HasSuffix(fn, ":2,SZ") {
+		t.Errorf(`GetFile() = %v, %v, expected the Z flag kept`, fn, err)
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	br, enc, err := e.decrypt(bufio.NewReader(f))
+	if err != nil || !enc {
+		t.Fatalf(`decrypt() = %v, %v, expected an encrypted message`, enc, err)
+	}
+	if c, err := detect(br); err != nil || c != Gzip {
+		t.Errorf(`detect() = %v, %v, expected gzip kept`, c, err)
+	}
+}
+
+func TestRescan(t *testing.T) {
+	d := newTestMaildir()
+	k1 := deliverTest(d, "Subject: a\r\n\r\na\r\n", "S")
+	k2 := deliverTest(d, "Subject: b\r\n\r\nb\r\n", "S")
+	k3 := deliverTest(d, "Subject: c\r\n\r\nc\r\n", "S")
+	fn1, _ := d.GetFile(k1)
+	fn2, _ := d.GetFile(k2)
+	if rs, err := d.Rescan(); err != nil || len(rs) != 0 {
+		t.Errorf(`Rescan() = %v, %v, expected no renames`, rs, err)
+	}
+
+	if err := os.Rename(fn1, path.Join(d.dir, cur, string(k1)+":2,FS")); err != nil {
+		panic(err)
+	}
+	if err := os.Remove(fn2); err != nil {
+		panic(err)
+	}
+	rs, err := d.Rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byKey := make(map[Key]Rename)
+	for _, r := range rs {
+		byKey[r.Key] = r
+	}
+	if len(rs) != 2 {
+		t.Errorf(`Rescan() = %v, expected 2 renames`, rs)
+	}
+	if r := byKey[k1]; r.From != path.Join(cur, string(k1)+":2,S") || r.To != path.Join(cur, string(k1)+":2,FS") {
+		t.Errorf(`Rescan() = %+v, expected a rename of %v to flags FS`, r, k1)
+	}
+	if r, ok := byKey[k2]; !ok || r.From != path.Join(cur, string(k2)+":2,S") || r.To != "" {
+		t.Errorf(`Rescan() = %+v, expected %v removed`, r, k2)
+	}
+	if _, ok := byKey[k3]; ok {
+		t.Errorf(`Rescan() reported %v, which wasn't touched`, k3)
+	}
+	if rs, err := d.Rescan(); err != nil || len(rs) != 0 {
+		t.Errorf(`Rescan() = %v, %v, expected no renames the second time`, rs, err)
+	}
+}
+
+func TestEscapeHostname(t *testing.T) {
+	if h := escapeHostname("a/b:c,d.example"); h != `a\057b\072c\054d.example` {
+		t.Errorf(`escapeHostname() = %v, expected a\057b\072c\054d.example`, h)
+	}
+}
+
+func TestDeliverRawNames(t *testing.T) {
+	d := newTestMaildir()
+	defer func(h string) { hostname = h }(hostname)
+	hostname = escapeHostname("mail/host:1,a")
+	name := regexp.MustCompile(`^(\d+)\.M\d+P(\d+)R[0-9a-f]+(?:I[0-9a-f]+V[0-9a-f]+)?Q(\d+)\.(.*),S=(\d+)$`)
+
+	at := time.Unix(1500000000, 0)
+	body := "Subject: a\r\n\r\na\r\n"
+	k, err := d.DeliverRawAt(strings.NewReader(body), "S", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := name.FindStringSubmatch(string(k))
+	if m == nil {
+		t.Fatalf(`DeliverRawAt() = %v, expected a name matching %v`, k, name)
+	}
+	if m[1] != "1500000000" {
+		t.Errorf(`DeliverRawAt() = %v, expected it to start with the delivery time`, k)
+	}
+	if m[2] != strconv.Itoa(os.Getpid()) {
+		t.Errorf(`DeliverRawAt() = %v, expected P%v`, k, os.Getpid())
+	}
+	if m[4] != `mail\057host\0721\054a` {
+		t.Errorf(`DeliverRawAt() = %v, expected the hostname escaped`, k)
+	}
+	if m[5] != strconv.Itoa(len(body)) {
+		t.Errorf(`DeliverRawAt() = %v, expected S=%v`, k, len(body))
+	}
+	fn, err := d.GetFile(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(at) {
+		t.Errorf(`DeliverRawAt() dated the file %v, expected %v`, fi.ModTime(), at)
+	}
+	if ino, dev, ok := inode(fi); ok && !strings.Contains(string(k), fmt.Sprintf("I%xV%xQ", ino, dev)) {
+		t.Errorf(`DeliverRawAt() = %v, expected I%xV%x`, k, ino, dev)
+	}
+
+	// Deliveries in the same second differ in their counter.
+	k2, err := d.DeliverRawAt(strings.NewReader(body), "S", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := name.FindStringSubmatch(string(k2))
+	if m2 == nil || k2 == k {
+		t.Fatalf(`DeliverRawAt() = %v, expected a name other than %v`, k2, k)
+	}
+	q, _ := strconv.Atoi(m[3])
+	if q2, _ := strconv.Atoi(m2[3]); q2 != q+1 {
+		t.Errorf(`DeliverRawAt() = %v, expected Q%v`, k2, q+1)
+	}
+
+	if k, err := d.DeliverRaw(strings.NewReader(body), ""); err != nil || !name.MatchString(string(k)) {
+		t.Errorf(`DeliverRaw() = %v, %v, expected a name matching %v`, k, err, name)
+	} else if s, _ := strconv.ParseInt(name.FindStringSubmatch(string(k))[1], 10, 64); time.Since(time.Unix(s, 0)) > time.Minute {
+		t.Errorf(`DeliverRaw() = %v, expected it dated now`, k)
+	}
+}
+
+func TestCleanTmp(t *testing.T) {
+	d := newTestMaildir()
+	old := path.Join(d.dir, tmp, "old")
+	recent := path.Join(d.dir, tmp, "recent")
+	for _, f := range []string{old, recent} {
+		if err := ioutil.WriteFile(f, []byte("partial"), 0600); err != nil {
+			panic(err)
+		}
+	}
+	past := time.Now().Add(-staleTmpAge - time.Hour)
+	if err := os.Chtimes(old, past, past); err != nil {
+		panic(err)
+	}
+	if err := d.CleanTmp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf(`CleanTmp() kept a file older than %v`, staleTmpAge)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf(`CleanTmp() removed a recent file: %v`, err)
+	}
+}
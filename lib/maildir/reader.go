@@ -0,0 +1,179 @@
+package maildir
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Message describes a message file found in the maildir.
+type Message struct {
+	Key  Key
+	Path string
+	// New is whether the message is in "new" rather than "cur".
+	New bool
+	// Flags are the maildir flags of the file name, e.g. "RS".
+	Flags   string
+	Size    int64
+	ModTime time.Time
+}
+
+// Rename records a message whose file was renamed, or removed, by someone
+// else. Paths are relative to the maildir; To is empty if the file is gone.
+type Rename struct {
+	Key      Key
+	From, To string
+}
+
+// parseName splits the name of a message file into its key and flags.
+func parseName(name string) (Key, string) {
+	k := keyForName(name)
+	info := strings.TrimPrefix(name, string(k))
+	if strings.HasPrefix(info, ":2,") {
+		return k, info[len(":2,"):]
+	}
+	return k, ""
+}
+
+// Walk calls fn for each message in new and cur, in no particular order,
+// until fn returns an error, which Walk returns. The directories are read a
+// chunk at a time, so large maildirs aren't held in memory. Dot files, which
+// the spec reserves, are skipped.
+func (d Maildir) Walk(fn func(Message) error) error {
+	for _, t := range []string{nw, cur} {
+		if err := d.walkDir(t, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d Maildir) walkDir(t string, fn func(Message) error) error {
+	f, err := os.Open(path.Join(d.dir, t))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		fis, err := f.Readdir(1024)
+		for _, fi := range fis {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			k, flags := parseName(fi.Name())
+			m := Message{
+				Key:     k,
+				Path:    path.Join(d.dir, t, fi.Name()),
+				New:     t == nw,
+				Flags:   flags,
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			}
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Open opens the message with key k for reading, like OpenFile.
+func (d Maildir) Open(k Key) (io.ReadCloser, error) {
+	fn, err := d.GetFile(k)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.OpenFile(fn)
+	if os.IsNotExist(err) {
+		// Renamed since we looked it up; look again.
+		if fn, err = d.GetFile(k); err != nil {
+			return nil, err
+		}
+		f, err = d.OpenFile(fn)
+	}
+	return f, err
+}
+
+// OpenFile opens the message file fn for reading, decrypting and
+// decompressing it if need be. Encrypted messages fail with ErrNoIdentity if
+// the maildir has no identities.
+func (d Maildir) OpenFile(fn string) (io.ReadCloser, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	br, _, err := d.decrypt(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := decompress(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closers = append(r.closers, f.Close)
+	return r, nil
+}
+
+// MoveToCur moves the message with key k from new to cur, as a mail reader
+// does once it has seen it, and returns its new path. Messages already in cur
+// are left alone.
+func (d Maildir) MoveToCur(k Key) (string, error) {
+	fn, err := d.GetFile(k)
+	if err != nil {
+		return "", err
+	}
+	if path.Base(path.Dir(fn)) != nw {
+		return fn, nil
+	}
+	name := path.Base(fn)
+	if !strings.Contains(name, ":") {
+		z, err := d.isCompressed(fn)
+		if err != nil {
+			return "", err
+		}
+		name += ":2," + withFlag("", compressedFlag, z)
+	}
+	to := path.Join(d.dir, cur, name)
+	if err := os.Rename(fn, to); err != nil {
+		return "", err
+	}
+	d.idx.set(d.dir, k, path.Join(cur, name))
+	if err := syncDir(path.Join(d.dir, cur)); err != nil {
+		return to, err
+	}
+	return to, syncDir(path.Join(d.dir, nw))
+}
+
+// MoveOut moves the message with key k out of the maildir, into dir, keeping
+// its file name, and returns its new path.
+func (d Maildir) MoveOut(k Key, dir string) (string, error) {
+	fn, err := d.GetFile(k)
+	if err != nil {
+		return "", err
+	}
+	to := path.Join(dir, path.Base(fn))
+	if err := os.Rename(fn, to); err != nil {
+		return "", err
+	}
+	d.idx.del(d.dir, k)
+	if err := syncDir(dir); err != nil {
+		return to, err
+	}
+	return to, syncDir(path.Dir(fn))
+}
+
+// Rescan lists new and cur again, and returns the messages whose files have
+// been renamed or removed by someone else, such as a mail reader changing
+// their flags, since they were last looked up.
+func (d Maildir) Rescan() ([]Rename, error) {
+	return d.idx.rescan(d.dir)
+}
@@ -21,7 +21,9 @@ const (
 	Secret = "u02Pz9c3cSR1Aii_3qzuAxXX"
 )
 
-func GetOAuthClient(ctx context.Context, cfg *oauth2.Config) (*oauth2.Token, error) {
+// GetOAuthClient runs the OAuth exchange for cfg. Any opts are passed along to
+// the authorization URL, e.g. to request incremental authorization.
+func GetOAuthClient(ctx context.Context, cfg *oauth2.Config, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	tok := new(oauth2.Token)
 	// Have to get a new token.
 	browser := os.Getenv("OAUTH") != "NOBROWSER"
@@ -29,12 +31,12 @@ func GetOAuthClient(ctx context.Context, cfg *oauth2.Config) (*oauth2.Token, err
 	var err error
 	if browser {
 		print("Launching browser for OAuth exchange. To skip, rerun with environment variable 'OAUTH' set to 'NOBROWSER'.\n")
-		code, err = tokenFromWeb(ctx, cfg)
+		code, err = tokenFromWeb(ctx, cfg, opts...)
 	}
 	if err != nil || !browser {
 		// Fall back to non-browser auth by rewriting the redirect URL and reading the auth code from stdin.
 		cfg.RedirectURL = "urn:ietf:wg:oauth:2.0:oob"
-		authURL := cfg.AuthCodeURL("")
+		authURL := cfg.AuthCodeURL("", opts...)
 		fmt.Printf("Authorize this app at %s and paste the authorization code.\n> ", authURL)
 		_, err = fmt.Scanf("%s", &code)
 	}
@@ -42,7 +44,7 @@ func GetOAuthClient(ctx context.Context, cfg *oauth2.Config) (*oauth2.Token, err
 	return tok, nil
 }
 
-func tokenFromWeb(ctx context.Context, config *oauth2.Config) (string, error) {
+func tokenFromWeb(ctx context.Context, config *oauth2.Config, opts ...oauth2.AuthCodeOption) (string, error) {
 	ch := make(chan string)
 	randState := fmt.Sprintf("st%d", time.Now().UnixNano())
 	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -65,7 +67,7 @@ func tokenFromWeb(ctx context.Context, config *oauth2.Config) (string, error) {
 	}))
 	defer ts.Close()
 	config.RedirectURL = ts.URL
-	authURL := config.AuthCodeURL(randState)
+	authURL := config.AuthCodeURL(randState, opts...)
 	errs := make(chan error)
 	go func() {
 		err := openURL(authURL)
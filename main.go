@@ -7,6 +7,7 @@ import (
 
 	"github.com/meelapshah/outtake/lib"
 	"github.com/meelapshah/outtake/lib/gmail"
+	"github.com/meelapshah/outtake/lib/maildir"
 	"github.com/urfave/cli"
 )
 
@@ -14,6 +15,127 @@ const (
 	progressUpdateFreqSecs = 2.0
 )
 
+// openGmail creates the output maildir if needed and sets up a Gmail
+// synchronizer for it, according to the global flags.
+func openGmail(ctx *cli.Context) (*gmail.Gmail, error) {
+	d := ctx.GlobalString("directory")
+	if d == "" {
+		return nil, fmt.Errorf("Missing --directory flag")
+	}
+	if s, err := os.Stat(d); err != nil && os.IsNotExist(err) {
+		if err := os.MkdirAll(d, 0766); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if !s.IsDir() {
+		return nil, fmt.Errorf("%s exists and is not a directory", d)
+	}
+	features := gmail.WriteBack
+	if ctx.GlobalBool("readonly") {
+		features = 0
+	} else if ctx.GlobalBool("drafts") {
+		features |= gmail.Drafts
+	}
+	gmail.MessageBufferSize = ctx.GlobalInt("buffer")
+	gmail.ConcurrentDownloads = ctx.GlobalInt("parallel")
+	gmail.MemoryBudget = int64(ctx.GlobalInt("memory")) << 20
+	gmail.WriteGmailHeaders = ctx.GlobalBool("gmail-headers")
+	gmail.SyncThreads = ctx.GlobalBool("threads")
+	gmail.SyncDrafts = ctx.GlobalBool("drafts")
+	gmail.RetainNewerThan = ctx.GlobalString("newer-than")
+	gmail.RetainPerLabel = ctx.GlobalInt("per-label")
+	if s := ctx.GlobalString("max-size"); s != "" {
+		n, err := gmail.ParseSize(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad --max-size: %v", err)
+		}
+		gmail.MaxMessageSize = n
+	}
+	gmail.CacheBackend = ctx.GlobalString("cache")
+	gmail.SQLiteBusyTimeout = ctx.GlobalDuration("busy-timeout")
+	gmail.Compression = ctx.GlobalString("compress")
+	gmail.EncryptTo = ctx.GlobalStringSlice("encrypt-to")
+	gmail.IdentityFile = ctx.GlobalString("identity")
+	return gmail.NewGmail(d, ctx.GlobalString("label"), features)
+}
+
+// syncDrafts syncs the drafts folder, if --drafts was given.
+func syncDrafts(g *gmail.Gmail) error {
+	if !gmail.SyncDrafts {
+		return nil
+	}
+	return g.SyncDrafts()
+}
+
+// printProgress returns a channel whose progress reports are printed to the
+// terminal.
+func printProgress() chan<- lib.Progress {
+	progress := make(chan lib.Progress)
+	go func() {
+		l := time.Time{}
+		for p := range progress {
+			if time.Since(l).Seconds() > progressUpdateFreqSecs {
+				l = time.Now()
+				fmt.Printf("\r%d / %d   %.2f%%  ", p.Current, p.Total, float32(p.Current)/float32(p.Total)*100)
+			}
+		}
+		fmt.Println()
+	}()
+	return progress
+}
+
+// convertMaildir rewrites the messages in the maildir in place, with
+// compression method and the encryption given by the global flags. A nil
+// method keeps each message's compression. Encrypted messages are only
+// decrypted if decrypt is set.
+func convertMaildir(ctx *cli.Context, method *string, decrypt bool) error {
+	d := ctx.GlobalString("directory")
+	if d == "" {
+		return exitError(fmt.Errorf("Missing --directory flag"))
+	}
+	c := maildir.NoCompression
+	if method != nil {
+		var err error
+		if c, err = maildir.ParseCompression(*method); err != nil {
+			return exitError(err)
+		}
+	}
+	rs, ids, err := maildir.LoadKeys(ctx.GlobalStringSlice("encrypt-to"), ctx.GlobalString("identity"))
+	if err != nil {
+		return exitError(err)
+	}
+	md, err := maildir.Create(d)
+	if err != nil {
+		return exitError(err)
+	}
+	md = md.WithCompression(c).WithEncryption(rs, ids)
+	if method == nil {
+		md = md.KeepingCompression()
+	}
+	n, err := md.Convert(decrypt, printProgress())
+	fmt.Println("Rewrote", n, "messages")
+	if err != nil {
+		return exitError(err)
+	}
+	return nil
+}
+
+// compressFlag returns the --compress method, or nil if it wasn't given.
+func compressFlag(ctx *cli.Context) *string {
+	if !ctx.GlobalIsSet("compress") {
+		return nil
+	}
+	method := ctx.GlobalString("compress")
+	return &method
+}
+
+// exitError makes the command exit with status 1 after printing err to
+// stderr, so that scripts and timers running it notice the failure.
+func exitError(err error) error {
+	return cli.NewExitError(fmt.Sprint("Error: ", err), 1)
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "outtake"
@@ -43,49 +165,409 @@ func main() {
 			Usage: "Max parallel downloads",
 			Value: 8,
 		},
+		cli.IntFlag{
+			Name:  "memory",
+			Usage: "Approximate MB of messages downloaded at once",
+			Value: 256,
+		},
+		cli.BoolFlag{
+			Name:  "readonly",
+			Usage: "Don't push notmuch tag changes back to Gmail (requests read-only access)",
+		},
+		cli.BoolFlag{
+			Name:  "gmail-headers",
+			Usage: "Add X-GM-MSGID, X-GM-THRID and X-GM-Internal-Date headers to delivered messages",
+		},
+		cli.BoolFlag{
+			Name:  "threads",
+			Usage: "With --label, also sync the other messages of the label's threads, and add X-GM-THRID headers",
+		},
+		cli.StringFlag{
+			Name:  "max-size",
+			Usage: "Store messages larger than this, e.g. 10M, without their attachments",
+		},
+		cli.StringFlag{
+			Name:  "newer-than",
+			Usage: "Only keep messages received after this date (YYYY-MM-DD) or within this age, e.g. 30d, 6w, 12m or 1y",
+		},
+		cli.IntFlag{
+			Name:  "per-label",
+			Usage: "Only keep the most recent N messages of each label",
+		},
+		cli.BoolFlag{
+			Name:  "drafts",
+			Usage: "Sync drafts to the .Drafts folder, uploading drafts written there unless --readonly",
+		},
+		cli.StringFlag{
+			Name:  "cache",
+			Usage: "Cache backend: bolt or sqlite",
+			Value: gmail.BoltBackend,
+		},
+		cli.DurationFlag{
+			Name:  "busy-timeout",
+			Usage: "How long to wait for another outtake to release the sqlite cache",
+			Value: gmail.SQLiteBusyTimeout,
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "Compress delivered messages: gzip, zstd or none (notmuch can't read zstd, so it turns off notmuch tag sync)",
+		},
+		cli.StringSliceFlag{
+			Name:  "encrypt-to",
+			Usage: "Encrypt delivered messages to this age recipient (age1...); turns off notmuch tag sync",
+		},
+		cli.StringFlag{
+			Name:  "identity",
+			Usage: "File of age identities to decrypt messages with",
+		},
 	}
-	app.Action = func(ctx *cli.Context) {
-		d := ctx.String("directory")
-		if d == "" {
-			fmt.Println("Missing --directory flag")
-			return
-		}
-		if s, err := os.Stat(d); err != nil && os.IsNotExist(err) {
-			if err := os.MkdirAll(d, 0766); err != nil {
-				fmt.Println("Error: ", err)
-				return
-			}
-		} else if err != nil {
-			fmt.Println("Error: ", err)
-			return
-		} else if !s.IsDir() {
-			fmt.Printf("Error: %d exists and is not a directory\n", d)
-			return
-		}
-		g, err := gmail.NewGmail(d, ctx.String("label"))
+	app.Action = func(ctx *cli.Context) error {
+		g, err := openGmail(ctx)
 		if err != nil {
-			fmt.Println("Error: ", err)
-			return
+			return exitError(err)
 		}
-		gmail.MessageBufferSize = ctx.Int("buffer")
-		gmail.ConcurrentDownloads = ctx.Int("parallel")
-		progress := make(chan lib.Progress)
-		go func() {
-			l := time.Time{}
-			for p := range progress {
-				if time.Since(l).Seconds() > progressUpdateFreqSecs {
-					l = time.Now()
-					fmt.Printf("\r%d / %d   %.2f%%  ", p.Current, p.Total, float32(p.Current)/float32(p.Total)*100)
-				}
-			}
-			fmt.Println()
-		}()
-		if err := g.Sync(ctx.Bool("full"), progress); err != nil {
-			panic(err)
+		defer g.Close()
+		if err := g.Sync(ctx.Bool("full"), printProgress()); err != nil {
+			return exitError(err)
+		} else if err := syncDrafts(g); err != nil {
+			return exitError(err)
 		} else if err := g.SyncNotmuch(); err != nil {
-			panic(err)
+			return exitError(err)
 		}
-
+		return nil
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "rebuild-cache",
+			Usage: "Rebuild a lost cache from the messages in the maildir",
+			Action: func(ctx *cli.Context) error {
+				g, err := openGmail(ctx)
+				if err != nil {
+					return exitError(err)
+				}
+				defer g.Close()
+				if err := g.RebuildCache(printProgress()); err != nil {
+					return exitError(err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "import-takeout",
+			Usage:     "Seed the maildir and cache from a Google Takeout mbox",
+			ArgsUsage: "mbox",
+			Action: func(ctx *cli.Context) error {
+				f, err := os.Open(ctx.Args().First())
+				if err != nil {
+					return exitError(err)
+				}
+				defer f.Close()
+				fi, err := f.Stat()
+				if err != nil {
+					return exitError(err)
+				}
+				g, err := openGmail(ctx)
+				if err != nil {
+					return exitError(err)
+				}
+				defer g.Close()
+				if err := g.ImportTakeout(f, fi.Size(), printProgress()); err != nil {
+					return exitError(err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "threads",
+			Usage:     "List the cached threads, or print the files of a thread's messages",
+			ArgsUsage: "[thread or message ID]",
+			Action: func(ctx *cli.Context) error {
+				g, err := openGmail(ctx)
+				if err != nil {
+					return exitError(err)
+				}
+				defer g.Close()
+				if id := ctx.Args().First(); id != "" {
+					files, err := g.ThreadFiles(id)
+					if err != nil {
+						return exitError(err)
+					}
+					for _, f := range files {
+						fmt.Println(f)
+					}
+					return nil
+				}
+				threads, err := g.Threads()
+				if err != nil {
+					return exitError(err)
+				}
+				for _, t := range threads {
+					fmt.Printf("%v\t%d\n", t.Id, len(t.Msgs))
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "fetch-attachment",
+			Usage:     "Download attachments left out of a message by --max-size",
+			ArgsUsage: "message-id [part...]",
+			Action: func(ctx *cli.Context) error {
+				if ctx.NArg() < 1 {
+					return exitError(fmt.Errorf("Missing message ID"))
+				}
+				g, err := openGmail(ctx)
+				if err != nil {
+					return exitError(err)
+				}
+				defer g.Close()
+				n, err := g.FetchAttachments(ctx.Args().First(), ctx.Args().Tail())
+				if err != nil {
+					return exitError(err)
+				}
+				fmt.Println("Fetched", n, "attachments.")
+				return nil
+			},
+		},
+		{
+			Name:  "verify",
+			Usage: "Check the cache against the maildir, and optionally Gmail",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "server",
+					Usage: "Also compare the cache with Gmail",
+				},
+				cli.BoolFlag{
+					Name:  "scrub",
+					Usage: "Re-hash every message to detect corruption",
+				},
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Fix the problems found",
+				},
+				cli.StringFlag{
+					Name:  "quarantine",
+					Usage: "With --repair, move orphan files that belong to no Gmail message to this directory",
+				},
+				cli.BoolFlag{
+					Name:  "drop-orphans",
+					Usage: "With --repair, delete orphan files that belong to no Gmail message",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				g, err := openGmail(ctx)
+				if err != nil {
+					return exitError(err)
+				}
+				defer g.Close()
+				r, err := g.Verify(gmail.VerifyOptions{
+					Server:        ctx.Bool("server"),
+					Scrub:         ctx.Bool("scrub"),
+					Repair:        ctx.Bool("repair"),
+					QuarantineDir: ctx.String("quarantine"),
+					DropOrphans:   ctx.Bool("drop-orphans"),
+				}, printProgress())
+				if err != nil {
+					return exitError(err)
+				}
+				for _, p := range r.Problems {
+					fmt.Println(p)
+				}
+				fmt.Println(r.Summary())
+				return nil
+			},
+		},
+		{
+			Name:      "export",
+			Usage:     "Export messages to an mbox, a directory of .eml files, or a tar or zip archive",
+			ArgsUsage: "output",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "mbox, eml, tar or zip",
+					Value: gmail.MboxFormat,
+				},
+				cli.StringSliceFlag{
+					Name:  "label",
+					Usage: "Only export messages with this label",
+				},
+				cli.StringFlag{
+					Name:  "after",
+					Usage: "Only export messages received on or after this date (YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "before",
+					Usage: "Only export messages received before this date (YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "query",
+					Usage: "Only export messages matching this query, e.g. \"label:Work -label:SPAM larger:1M\"",
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				out := ctx.Args().First()
+				if out == "" {
+					return exitError(fmt.Errorf("Missing output"))
+				}
+				opts := gmail.ExportOptions{
+					Format: ctx.String("format"),
+					Labels: ctx.StringSlice("label"),
+					Query:  ctx.String("query"),
+				}
+				for _, d := range []struct {
+					flag string
+					t    *time.Time
+				}{{"after", &opts.After}, {"before", &opts.Before}} {
+					if v := ctx.String(d.flag); v != "" {
+						var err error
+						if *d.t, err = gmail.ParseDate(v); err != nil {
+							return exitError(err)
+						}
+					}
+				}
+				g, err := openGmail(ctx)
+				if err != nil {
+					return exitError(err)
+				}
+				defer g.Close()
+				var progress chan<- lib.Progress
+				if out != "-" {
+					progress = printProgress()
+				}
+				n, err := g.Export(out, opts, progress)
+				fmt.Fprintln(os.Stderr, "Exported", n, "messages")
+				if err != nil {
+					return exitError(err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "compress",
+			Usage: "Compress the messages already in the maildir",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "method",
+					Usage: "gzip or zstd",
+					Value: string(maildir.Zstd),
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				method := ctx.String("method")
+				return convertMaildir(ctx, &method, false)
+			},
+		},
+		{
+			Name:  "decompress",
+			Usage: "Decompress the messages in the maildir",
+			Action: func(ctx *cli.Context) error {
+				method := string(maildir.NoCompression)
+				return convertMaildir(ctx, &method, false)
+			},
+		},
+		{
+			Name:  "encrypt",
+			Usage: "Encrypt the messages in the maildir to the --encrypt-to recipients",
+			Action: func(ctx *cli.Context) error {
+				if len(ctx.GlobalStringSlice("encrypt-to")) == 0 {
+					return exitError(fmt.Errorf("Missing --encrypt-to flag"))
+				}
+				return convertMaildir(ctx, compressFlag(ctx), false)
+			},
+		},
+		{
+			Name:  "decrypt",
+			Usage: "Decrypt the messages in the maildir with the --identity file",
+			Action: func(ctx *cli.Context) error {
+				if ctx.GlobalString("identity") == "" {
+					return exitError(fmt.Errorf("Missing --identity flag"))
+				}
+				return convertMaildir(ctx, compressFlag(ctx), true)
+			},
+		},
+		{
+			Name:  "migrate-cache",
+			Usage: "Copy the cache from the --from backend to the --cache backend",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "Backend to copy the cache from",
+					Value: gmail.BoltBackend,
+				},
+			},
+			Action: func(ctx *cli.Context) error {
+				d := ctx.GlobalString("directory")
+				if d == "" {
+					return exitError(fmt.Errorf("Missing --directory flag"))
+				}
+				gmail.SQLiteBusyTimeout = ctx.GlobalDuration("busy-timeout")
+				if err := gmail.MigrateCache(d, ctx.String("from"), ctx.GlobalString("cache")); err != nil {
+					return exitError(err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "Dump or load the cache",
+			Subcommands: []cli.Command{
+				{
+					Name:      "dump",
+					Usage:     "Write the cache as JSON lines",
+					ArgsUsage: "[file]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "with-token",
+							Usage: "Include the OAuth token",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						d := ctx.GlobalString("directory")
+						if d == "" {
+							return exitError(fmt.Errorf("Missing --directory flag"))
+						}
+						gmail.CacheBackend = ctx.GlobalString("cache")
+						gmail.SQLiteBusyTimeout = ctx.GlobalDuration("busy-timeout")
+						w := os.Stdout
+						if f := ctx.Args().First(); f != "" {
+							var err error
+							if w, err = os.OpenFile(f, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+								return exitError(err)
+							}
+							defer w.Close()
+						}
+						if err := gmail.DumpCache(d, w, ctx.Bool("with-token")); err != nil {
+							return exitError(err)
+						}
+						return nil
+					},
+				},
+				{
+					Name:      "load",
+					Usage:     "Load a cache dump into an empty cache",
+					ArgsUsage: "[file]",
+					Action: func(ctx *cli.Context) error {
+						d := ctx.GlobalString("directory")
+						if d == "" {
+							return exitError(fmt.Errorf("Missing --directory flag"))
+						}
+						gmail.CacheBackend = ctx.GlobalString("cache")
+						gmail.SQLiteBusyTimeout = ctx.GlobalDuration("busy-timeout")
+						r := os.Stdin
+						if f := ctx.Args().First(); f != "" {
+							var err error
+							if r, err = os.Open(f); err != nil {
+								return exitError(err)
+							}
+							defer r.Close()
+						}
+						if err := gmail.LoadCache(d, r); err != nil {
+							return exitError(err)
+						}
+						return nil
+					},
+				},
+			},
+		},
 	}
 	app.Run(os.Args)
 }